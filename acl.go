@@ -0,0 +1,321 @@
+package tcp_server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessList decides which addresses may connect to a server, from lists of allowed and denied addresses and networks, and temporary bans.
+// An address is refused if it is banned, if it matches a denied entry, or if the allowed list isn't empty and it matches nothing in it.
+// It is safe to change while the server is running.
+type AccessList struct {
+	sync.Mutex
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	bans     map[string]time.Time
+	onReload func(err error)
+}
+
+// Ban is an address refused until a given time.
+type Ban struct {
+	IP string
+	// The zero time if the ban doesn't expire.
+	Until time.Time
+}
+
+// Creates an empty access list, which allows every address.
+func NewAccessList() *AccessList {
+	return &AccessList{
+		bans: make(map[string]time.Time),
+	}
+}
+
+// Parses an IP address or CIDR network, with a single address becoming a network containing only itself.
+func parseNet(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s", ErrInvalidAddress, entry)
+		}
+		return n, nil
+	}
+	ip := parseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("%w %s", ErrInvalidAddress, entry)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Parses an IP address, ignoring the zone of an IPv6 address such as fe80::1%eth0.
+func parseIP(ip string) net.IP {
+	if i := strings.IndexByte(ip, '%'); i >= 0 {
+		ip = ip[:i]
+	}
+	return net.ParseIP(ip)
+}
+
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func netsRemove(nets []*net.IPNet, n *net.IPNet) ([]*net.IPNet, bool) {
+	for i, existing := range nets {
+		if existing.String() == n.String() {
+			return append(nets[:i:i], nets[i+1:]...), true
+		}
+	}
+	return nets, false
+}
+
+// Adds an IP address or CIDR network to the allowed list.
+func (a *AccessList) Allow(entry string) error {
+	n, err := parseNet(entry)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	a.allow = append(a.allow, n)
+	a.Unlock()
+	return nil
+}
+
+// Adds an IP address or CIDR network to the denied list.
+func (a *AccessList) Deny(entry string) error {
+	n, err := parseNet(entry)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	a.deny = append(a.deny, n)
+	a.Unlock()
+	return nil
+}
+
+// Removes an entry from the allowed list. Returns false if it wasn't there.
+func (a *AccessList) RemoveAllow(entry string) bool {
+	n, err := parseNet(entry)
+	if err != nil {
+		return false
+	}
+	a.Lock()
+	defer a.Unlock()
+	var removed bool
+	a.allow, removed = netsRemove(a.allow, n)
+	return removed
+}
+
+// Removes an entry from the denied list. Returns false if it wasn't there.
+func (a *AccessList) RemoveDeny(entry string) bool {
+	n, err := parseNet(entry)
+	if err != nil {
+		return false
+	}
+	a.Lock()
+	defer a.Unlock()
+	var removed bool
+	a.deny, removed = netsRemove(a.deny, n)
+	return removed
+}
+
+// Refuses an IP address for the given duration, or until it is unbanned if the duration is 0.
+// Banning an address again replaces the earlier ban.
+func (a *AccessList) Ban(ip string, d time.Duration) error {
+	parsed := parseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("%w %s", ErrInvalidAddress, ip)
+	}
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	a.Lock()
+	a.bans[parsed.String()] = until
+	a.Unlock()
+	return nil
+}
+
+// Lifts the ban on an IP address. Returns false if it wasn't banned.
+func (a *AccessList) Unban(ip string) bool {
+	parsed := parseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	a.Lock()
+	defer a.Unlock()
+	until, exists := a.bans[parsed.String()]
+	delete(a.bans, parsed.String())
+	return exists && (until.IsZero() || time.Now().Before(until))
+}
+
+// Returns the addresses currently banned, sorted by address.
+func (a *AccessList) Bans() []Ban {
+	now := time.Now()
+	a.Lock()
+	bans := make([]Ban, 0, len(a.bans))
+	for ip, until := range a.bans {
+		if !until.IsZero() && !now.Before(until) {
+			delete(a.bans, ip)
+			continue
+		}
+		bans = append(bans, Ban{IP: ip, Until: until})
+	}
+	a.Unlock()
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// Returns the reason an IP address must be refused, or 0 if it may connect.
+// An address that can't be parsed is only allowed while the allowed list is empty.
+func (a *AccessList) Check(ip string) RejectReason {
+	parsed := parseIP(ip)
+	a.Lock()
+	defer a.Unlock()
+	if parsed == nil {
+		if len(a.allow) > 0 {
+			return RejectDenied
+		}
+		return 0
+	}
+	if until, banned := a.bans[parsed.String()]; banned {
+		if until.IsZero() || time.Now().Before(until) {
+			return RejectBanned
+		}
+		delete(a.bans, parsed.String())
+	}
+	if netsContain(a.deny, parsed) {
+		return RejectDenied
+	}
+	if len(a.allow) > 0 && !netsContain(a.allow, parsed) {
+		return RejectDenied
+	}
+	return 0
+}
+
+// Replaces the allowed and denied lists with the ones in a file, leaving bans as they are.
+// Each line of the file is "allow" or "deny", followed by an IP address or CIDR network.
+// Empty lines and lines starting with # are ignored.
+// If the file can't be read or has an invalid line, the lists aren't changed.
+func (a *AccessList) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var allow, deny []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return errors.New(path + ": invalid line " + text)
+		}
+		n, err := parseNet(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			allow = append(allow, n)
+		case "deny":
+			deny = append(deny, n)
+		default:
+			return errors.New(path + ": invalid line " + text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	a.Lock()
+	a.allow = allow
+	a.deny = deny
+	a.Unlock()
+	return nil
+}
+
+// Called after the file being watched with WatchFile is reloaded, with the error if it couldn't be.
+// An access list can be shared between servers, so no server's panic policy applies to the callback, and a panic in it isn't recovered.
+func (a *AccessList) OnReload(callback func(err error)) {
+	a.Lock()
+	a.onReload = callback
+	a.Unlock()
+}
+
+// Loads the allowed and denied lists from a file with LoadFile, then checks every interval whether the file has changed, and loads it again if it has, until ctx is done.
+// Returns the error from the first load, in which case the file isn't watched.
+func (a *AccessList) WatchFile(ctx context.Context, path string, interval time.Duration) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err = a.LoadFile(path); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		modTime, size := info.ModTime(), info.Size()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(path)
+			if err == nil && info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			if err == nil {
+				modTime, size = info.ModTime(), info.Size()
+				err = a.LoadFile(path)
+			}
+			a.Lock()
+			onReload := a.onReload
+			a.Unlock()
+			if onReload != nil {
+				onReload(err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Returns the server's access list.
+func (s *Server) AccessList() *AccessList {
+	s.Lock()
+	defer s.Unlock()
+	return s.acl
+}
+
+// Replaces the server's access list, which allows it to be shared between servers.
+func (s *Server) SetAccessList(a *AccessList) {
+	if a == nil {
+		a = NewAccessList()
+	}
+	s.Lock()
+	s.acl = a
+	s.Unlock()
+}
@@ -0,0 +1,204 @@
+package tcp_server
+
+import (
+	"log/slog"
+	"time"
+)
+
+// FailureKind is a kind of failure counted towards banning the address it came from.
+type FailureKind int
+
+const (
+	// A client failed to authenticate.
+	FailureAuth FailureKind = iota + 1
+	// A client broke the application's protocol.
+	FailureProtocol
+	// A client's message was dropped by a rate limit.
+	FailureRateLimit
+	// A client was rejected by the OnNewClient callback.
+	FailureRejected
+)
+
+func (k FailureKind) String() string {
+	switch k {
+	case FailureAuth:
+		return "authentication failed"
+	case FailureProtocol:
+		return "protocol error"
+	case FailureRateLimit:
+		return "rate limit exceeded"
+	case FailureRejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// BanPolicy decides when an address is banned automatically for its failures.
+type BanPolicy struct {
+	// Bans an address once it has this many failures within Window, which defaults to a minute. Set it to 0 to never ban automatically, which is the default.
+	MaxFailures int
+	Window      time.Duration
+	// How long the first ban of an address lasts, which defaults to a minute. Every later ban lasts twice as long as the one before, up to MaxDuration if it is set.
+	Duration    time.Duration
+	MaxDuration time.Duration
+	// How long after its last ban an address's later bans go back to lasting Duration. Defaults to a day.
+	ResetAfter time.Duration
+}
+
+// BanEvent reports an address banned automatically.
+type BanEvent struct {
+	IP    string
+	Until time.Time
+	// The failure that caused the ban, and how many failures there were within the window.
+	Kind     FailureKind
+	Failures int
+	// How many times the address has been banned, including this time.
+	Bans int
+}
+
+// The failures recorded for an address.
+type failureRecord struct {
+	failures []time.Time
+	bans     int
+	lastBan  time.Time
+}
+
+// Sets when addresses are banned automatically for their failures. Bans are added to the server's access list, so they can be listed and lifted there.
+func (s *Server) SetBanPolicy(policy BanPolicy) {
+	s.Lock()
+	s.banPolicy = policy
+	s.Unlock()
+}
+
+// Called when an address is banned automatically, after the ban is added to the access list and before the address's clients are disconnected.
+func (s *Server) OnBan(callback func(ev BanEvent)) {
+	s.Lock()
+	s.onBan = callback
+	s.Unlock()
+}
+
+// Records a failure for an IP address, banning it and disconnecting its clients if the ban policy says so.
+// Returns true if the address was banned.
+func (s *Server) ReportFailure(ip string, kind FailureKind) bool {
+	now := time.Now()
+	s.Lock()
+	policy := s.banPolicy
+	if policy.MaxFailures <= 0 {
+		s.Unlock()
+		return false
+	}
+	if s.failures == nil {
+		s.failures = make(map[string]*failureRecord)
+	}
+	s.sweepFailures(now)
+	if rec := s.failures[ip]; rec != nil {
+		s.pruneFailures(ip, rec, now)
+	}
+	rec := s.failures[ip]
+	if rec == nil {
+		rec = &failureRecord{}
+		s.failures[ip] = rec
+	}
+	rec.failures = append(rec.failures, now)
+	if len(rec.failures) < policy.MaxFailures {
+		s.Unlock()
+		return false
+	}
+	ev := BanEvent{
+		IP:       ip,
+		Kind:     kind,
+		Failures: len(rec.failures),
+	}
+	rec.failures = nil
+	rec.bans++
+	rec.lastBan = now
+	ev.Bans = rec.bans
+	d := policy.Duration
+	if d <= 0 {
+		d = time.Minute
+	}
+	for i := 1; i < rec.bans && (policy.MaxDuration <= 0 || d < policy.MaxDuration); i++ {
+		d *= 2
+	}
+	if policy.MaxDuration > 0 && d > policy.MaxDuration {
+		d = policy.MaxDuration
+	}
+	ev.Until = now.Add(d)
+	acl := s.acl
+	callback := s.onBan
+	s.Unlock()
+
+	if err := acl.Ban(ip, d); err != nil {
+		return false
+	}
+	s.log(slog.LevelWarn, "address banned", slog.String("ip", ip), slog.String("kind", kind.String()), slog.Int("failures", ev.Failures), slog.Time("until", ev.Until))
+	if callback != nil {
+		s.safely(nil, func() {
+			callback(ev)
+		})
+	}
+	for _, c := range s.clientsSorted() {
+		if c.IP() == ip {
+			c.closeWithReason(CloseBanned, nil)
+		}
+	}
+	return true
+}
+
+// Records a failure for the client's IP address. See Server.ReportFailure.
+func (c *Client) ReportFailure(kind FailureKind) bool {
+	return c.server.ReportFailure(c.IP(), kind)
+}
+
+// Forgets an address's failures older than the window, and its ban count if it is older than the reset period, forgetting the address entirely once nothing is left.
+// Must be called with the server locked.
+func (s *Server) pruneFailures(ip string, rec *failureRecord, now time.Time) {
+	resetAfter := s.banPolicy.ResetAfter
+	if resetAfter <= 0 {
+		resetAfter = time.Hour * 24
+	}
+	window := s.banPolicy.Window
+	if window <= 0 {
+		window = time.Minute
+	}
+	i := 0
+	for i < len(rec.failures) && now.Sub(rec.failures[i]) > window {
+		i++
+	}
+	rec.failures = rec.failures[i:]
+	if rec.bans > 0 && now.Sub(rec.lastBan) > resetAfter {
+		rec.bans = 0
+	}
+	if len(rec.failures) == 0 && rec.bans == 0 {
+		delete(s.failures, ip)
+	}
+}
+
+// Prunes every address at most once per window, or once a minute if that is longer, so that the addresses reporting no further failures are forgotten without every failure walking all of them.
+// Must be called with the server locked.
+func (s *Server) sweepFailures(now time.Time) {
+	every := max(s.banPolicy.Window, time.Minute)
+	if now.Sub(s.failuresSwept) < every {
+		return
+	}
+	s.failuresSwept = now
+	for ip, rec := range s.failures {
+		s.pruneFailures(ip, rec, now)
+	}
+}
+
+// Returns the addresses currently banned. See AccessList.Bans.
+func (s *Server) Bans() []Ban {
+	return s.AccessList().Bans()
+}
+
+// Lifts the ban on an IP address and forgets its failures, though not how many times it has been banned.
+// Returns false if it wasn't banned.
+func (s *Server) Unban(ip string) bool {
+	s.Lock()
+	if rec := s.failures[ip]; rec != nil {
+		rec.failures = nil
+	}
+	s.Unlock()
+	return s.AccessList().Unban(ip)
+}
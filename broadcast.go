@@ -0,0 +1,218 @@
+package tcp_server
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// SendStatus describes what happened to a broadcast message for a single client.
+type SendStatus int
+
+const (
+	// The client was excluded from the broadcast.
+	SendSkipped SendStatus = iota
+	// The message was sent to the client.
+	SendSent
+	// The message couldn't be sent to the client.
+	SendFailed
+)
+
+func (st SendStatus) String() string {
+	switch st {
+	case SendSkipped:
+		return "skipped"
+	case SendSent:
+		return "sent"
+	case SendFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// SendResult is the outcome of a broadcast for a single client.
+type SendResult struct {
+	Client *Client
+	Status SendStatus
+	// Set when Status is SendFailed.
+	Err error
+}
+
+// BroadcastResult holds the outcome of a broadcast for every client considered, in their connection order.
+type BroadcastResult struct {
+	Results []SendResult
+}
+
+func (r BroadcastResult) count(status SendStatus) int {
+	count := 0
+	for _, res := range r.Results {
+		if res.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the number of clients the message was sent to.
+func (r BroadcastResult) Sent() int {
+	return r.count(SendSent)
+}
+
+// Returns the number of clients that were excluded.
+func (r BroadcastResult) Skipped() int {
+	return r.count(SendSkipped)
+}
+
+// Returns the number of clients the message couldn't be sent to.
+func (r BroadcastResult) Failed() int {
+	return r.count(SendFailed)
+}
+
+// Send text message to every client for which include returns true.
+// The clients are considered in their connection order, though when the broadcast is shared between several goroutines include may be called concurrently, and it is called without any locks held.
+// Returns the outcome for every client, and a *BroadcastError if the message wasn't sent to any of them.
+func (s *Server) SendWhere(message string, include func(c *Client) bool) (BroadcastResult, error) {
+	return s.broadcast(s.clientsSorted(), message, include)
+}
+
+// Send text message to all clients except the clients excluded.
+// Returns the outcome for every client, and an error if the message wasn't sent to any of them.
+func (s *Server) SendAllExcept(message string, excluded ...*Client) (BroadcastResult, error) {
+	return s.SendWhere(message, excluding(excluded))
+}
+
+// Sets the maximum number of goroutines a single broadcast is shared between.
+// Set it to 0 to use runtime.GOMAXPROCS, which is the default, or 1 to send to each client in turn.
+func (s *Server) SetBroadcastParallelism(n int) {
+	s.Lock()
+	s.parallelism = n
+	s.Unlock()
+}
+
+// The fewest clients worth starting another goroutine for during a broadcast.
+const broadcastBatch = 64
+
+func (s *Server) broadcastWorkers(clients int) int {
+	s.Lock()
+	workers := s.parallelism
+	s.Unlock()
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if limit := (clients + broadcastBatch - 1) / broadcastBatch; workers > limit {
+		workers = limit
+	}
+	return workers
+}
+
+func excluding(excluded []*Client) func(c *Client) bool {
+	return func(c *Client) bool {
+		for _, ex := range excluded {
+			if c == ex {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Sends the message to clients, which must not be modified while this runs, returning the outcome for every client.
+func (s *Server) broadcast(clients []*Client, message string, include func(c *Client) bool) (BroadcastResult, error) {
+	res := BroadcastResult{Results: make([]SendResult, len(clients))}
+	_, err := s.deliver(clients, message, include, res.Results)
+	if _, ok := err.(*BroadcastError); err != nil && !ok {
+		// Nothing was attempted.
+		res.Results = nil
+	}
+	return res, err
+}
+
+// Sends the message to clients, which must not be modified while this runs, returning only the number it was sent to.
+// This spares building the outcome for every client, which matters for broadcasts to many thousands of them.
+func (s *Server) broadcastCount(clients []*Client, message string, include func(c *Client) bool) (int, error) {
+	return s.deliver(clients, message, include, nil)
+}
+
+// Sends the message to clients, recording the outcome for each one in results if it isn't nil, and returns the number of clients it was sent to.
+// The message is encoded once, and the clients are shared between the workers as each one becomes free, so a slow client only holds up the worker sending to it.
+func (s *Server) deliver(clients []*Client, message string, include func(c *Client) bool, results []SendResult) (int, error) {
+	encoded, err := encodeMessage(message)
+	if err != nil {
+		return 0, err
+	}
+	if len(clients) == 0 {
+		return 0, ErrNoClients
+	}
+	var sent atomic.Int64
+	// Without results, failures are only kept to report if the message was sent to nobody.
+	var fl sync.Mutex
+	var failures []SendResult
+	sendOne := func(i int) {
+		c := clients[i]
+		if results != nil {
+			results[i].Client = c
+		}
+		if include != nil && !include(c) {
+			return
+		}
+		if err := c.sendEncoded(encoded); err != nil {
+			if results != nil {
+				results[i].Status = SendFailed
+				results[i].Err = err
+			} else {
+				fl.Lock()
+				failures = append(failures, SendResult{Client: c, Status: SendFailed, Err: err})
+				fl.Unlock()
+			}
+			return
+		}
+		if results != nil {
+			results[i].Status = SendSent
+		}
+		sent.Add(1)
+	}
+	workers := s.broadcastWorkers(len(clients))
+	if workers <= 1 {
+		for i := range clients {
+			sendOne(i)
+		}
+	} else {
+		var wg sync.WaitGroup
+		next := int64(-1)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					i := int(atomic.AddInt64(&next, 1))
+					if i >= len(clients) {
+						return
+					}
+					sendOne(i)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	n := int(sent.Load())
+	if m := s.getMetrics(); m != nil {
+		m.Broadcast(n)
+	}
+	if n > 0 {
+		return n, nil
+	}
+	if results != nil {
+		for _, r := range results {
+			if r.Status == SendFailed {
+				failures = append(failures, r)
+			}
+		}
+	} else {
+		// The workers finish in any order, so put the failures back in connection order.
+		sort.Slice(failures, func(i, j int) bool {
+			return failures[i].Client.id < failures[j].Client.id
+		})
+	}
+	return 0, &BroadcastError{Failures: failures}
+}
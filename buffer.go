@@ -0,0 +1,53 @@
+package tcp_server
+
+import "sync"
+
+// Buffers larger than this aren't returned to the pool, so one long line doesn't keep its memory for good.
+const maxPooledBuffer = 64 * 1024
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 4096)
+		return &b
+	},
+}
+
+// Returns a pooled buffer, which should be handed back with putBuffer once it is no longer used.
+func getBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+	*b = (*b)[:cap(*b)]
+	buffers.Put(b)
+}
+
+// Appends the text of line to dst in a single pass, leaving out control and non-ASCII characters, and applying each backspace to the text appended so far.
+func appendSanitized(dst []byte, line []byte) []byte {
+	for _, chr := range line {
+		if chr == 8 {
+			if len(dst) > 0 {
+				dst = dst[:len(dst)-1]
+			}
+			continue
+		}
+		if chr < 32 || chr > 126 {
+			continue
+		}
+		dst = append(dst, chr)
+	}
+	return dst
+}
+
+// Sanitizes a line into a pooled buffer, so that the only allocation is the string returned.
+func sanitizeLine(line []byte) string {
+	b := getBuffer()
+	dst := appendSanitized((*b)[:0], line)
+	message := string(dst)
+	*b = dst
+	putBuffer(b)
+	return message
+}
@@ -2,15 +2,18 @@ package tcp_server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
-	"os"
-	"runtime"
-	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Client holds info about a connection to the server.
@@ -21,6 +24,8 @@ type Client struct {
 	connected       bool
 	authorized      bool
 	listening       bool
+	listenGen       int
+	hijacked        bool
 	callbackRunning bool
 	ip              string
 	host            string
@@ -28,12 +33,61 @@ type Client struct {
 	r               *bufio.Reader
 	p               sync.Mutex
 	pmsg            chan string
+	msgs            chan Message
+	done            chan struct{}
+	ctx             context.Context
+	cancel          context.CancelCauseFunc
 	prompt          bool
+	promptDone      chan struct{}
+	pulling         bool
 	w               *bufio.Writer
+	wl              sync.Mutex
+	q               sync.Mutex
+	qcond           *sync.Cond
+	queue           []string
+	qsize           int
+	qpolicy         QueuePolicy
+	qclosed         bool
+	writing         bool
 	id              float64
 	server          *Server
 	db              map[string]interface{}
 	dbl             sync.Mutex
+	handlers        []Handler
+	lb              *lineBuffer
+	fd              int
+	admitted        bool
+	subnet          string
+	rl              sync.Mutex
+	limiter         *limiter
+	ipLimiter       *limiter
+	strikes         int
+	rooms           map[string]*Room
+	idle            *time.Timer
+	connectedAt     time.Time
+	lastRead        atomic.Int64
+	lastSent        atomic.Int64
+	messagesIn      atomic.Int64
+	messagesOut     atomic.Int64
+	bytesIn         atomic.Int64
+	bytesOut        atomic.Int64
+	idleWarned      atomic.Bool
+	idleTimeout     time.Duration
+	idleWarning     time.Duration
+	idleMessage     string
+	writeTimeout    time.Duration
+	hbConfig        Heartbeat
+	hb              *time.Timer
+	awaitingPong    bool
+	pingSent        time.Time
+	rtt             time.Duration
+	closeErr        *CloseError
+	metrics         Metrics
+	tracer          Tracer
+	span            Span
+	handlerCtx      context.Context
+	// Set once the client has an ID, by which time other goroutines can already send to it.
+	transcript atomic.Pointer[TranscriptSink]
 }
 
 // Read a single line of data from the client without calling the callback function.
@@ -42,104 +96,328 @@ func (c *Client) Readln() (string, error) {
 }
 
 func (c *Client) readln() (string, error) {
+	for {
+		message, n, err := c.readLine()
+		if err != nil {
+			return "", err
+		}
+		if c.pong(message) {
+			continue
+		}
+		c.received(message, n)
+		return message, nil
+	}
+}
+
+// Reads the next line from the connection, which may be a reply to a heartbeat, returning it and its length on the wire.
+func (c *Client) readLine() (string, int, error) {
 	c.Lock()
 	if !c.connected {
 		c.Unlock()
-		return "", errors.New("client not connected")
+		return "", 0, ErrNotConnected
 	}
 	c.Unlock()
-	var message string
-	var err error
-	message, err = c.r.ReadString('\n')
-	if err != nil {
-		c.close()
-		return "", err
+	if c.lb != nil {
+		return c.readPending()
+	}
+	// Lines are sanitized straight out of the reader's buffer, a piece at a time if they don't fit in it.
+	b := getBuffer()
+	dst := (*b)[:0]
+	n := 0
+	for {
+		line, err := c.r.ReadSlice('\n')
+		n += len(line)
+		dst = appendSanitized(dst, line)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			putBuffer(b)
+			c.readFailed(err)
+			return "", 0, err
+		}
+		break
 	}
-	return stringFormatWithBS(message), err
+	message := string(dst)
+	*b = dst
+	putBuffer(b)
+	return message, n, nil
 }
 
-func (c *Client) listen() {
+// Records that a line of n bytes, other than a reply to a heartbeat, was received from the client.
+func (c *Client) received(message string, n int) {
+	c.touch()
+	c.record(TranscriptIn, message)
+	c.messagesIn.Add(1)
+	c.bytesIn.Add(int64(n))
+	if c.metrics != nil {
+		c.metrics.MessageReceived(n)
+	}
+}
+
+// Records that a message of n bytes on the wire was written to the client.
+func (c *Client) sent(message string, n int) {
+	c.lastSent.Store(time.Now().UnixNano())
+	c.record(TranscriptOut, message)
+	c.messagesOut.Add(1)
+	c.bytesOut.Add(int64(n))
+	if c.metrics != nil {
+		c.metrics.MessageSent(n)
+	}
+}
+
+// Starts a new generation of reading, so that any earlier reader stops after its handler returns.
+func (c *Client) startListening() int {
 	c.Lock()
-	c.authorized = true
+	defer c.Unlock()
 	c.listening = true
-	c.Unlock()
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Fprintln(os.Stderr, "Recovered from", r)
-			fmt.Fprintln(os.Stderr, debug.Stack())
-			c.close()
-		}
-		c.Lock()
+	c.listenGen++
+	return c.listenGen
+}
+
+// Deferred by readers, to recover from panics in the handlers, and to mark the client as no longer listening if the reader stopped without handing over to another.
+func (c *Client) stopListening(gen int) {
+	if r := recover(); r != nil {
+		c.recovered(r)
+	}
+	c.Lock()
+	if c.listenGen == gen {
 		c.listening = false
 		c.callbackRunning = false
-		c.Unlock()
-	}()
+	}
+	c.Unlock()
+}
+
+// Reports a panic recovered by a reader, and disconnects the client, as the reader can't carry on whatever the panic policy is.
+func (c *Client) recovered(r interface{}) {
+	c.server.panicked(c, r)
+	c.closeWithReason(ClosePanic, fmt.Errorf("%v", r))
+}
+
+// Starts reading messages in the background, using the server's event loop if the client is registered with it.
+func (c *Client) startReading() {
+	// The new generation starts before returning, so that a prompt the handler shows next is delivered by the new reader rather than read directly.
+	gen := c.startListening()
+	if c.lb != nil {
+		go c.servePending(gen)
+		return
+	}
+	go c.listen(gen)
+}
+
+func (c *Client) listen(gen int) {
+	defer c.stopListening(gen)
 	for {
 		message, err := c.readln()
 		if err != nil {
 			return
 		}
+		if !c.dispatch(message, gen) {
+			return
+		}
+	}
+}
+
+// Delivers a message to a waiting prompt, the Messages channel, or the message handlers.
+// Returns false if the reader of generation gen should stop, because the client disconnected, or the handler detached or hijacked it.
+func (c *Client) dispatch(message string, gen int) bool {
+	if !c.allowMessage(message) {
+		c.Lock()
+		defer c.Unlock()
+		return c.connected
+	}
+	for {
 		c.Lock()
 		prompt := c.prompt
+		promptDone := c.promptDone
 		c.Unlock()
-		if prompt {
-			c.pmsg <- message
-			continue
+		if !prompt {
+			break
 		}
+		// The prompt may have been answered by the previous message, and be about to end, in which case the message goes elsewhere.
+		select {
+		case c.pmsg <- message:
+			return true
+		case <-promptDone:
+		case <-c.done:
+			return false
+		}
+	}
+	c.Lock()
+	msgs := c.msgs
+	c.pulling = msgs != nil
+	c.Unlock()
+	if msgs != nil {
+		defer func() {
+			c.Lock()
+			c.pulling = false
+			c.Unlock()
+		}()
+		// A prompt may begin while we wait for the message to be received, in which case it is given the message instead.
+		select {
+		case msgs <- Message{Client: c, Text: message}:
+			return true
+		case c.pmsg <- message:
+			return true
+		case <-c.done:
+			return false
+		}
+	}
+	c.Lock()
+	c.listening = false
+	c.callbackRunning = true
+	c.Unlock()
+	var start time.Time
+	if c.metrics != nil {
+		start = time.Now()
+	}
+	ctx, span := c.startSpan(SpanMessage, slog.Int("tcp_server.message.bytes", len(message)))
+	if span != nil {
 		c.Lock()
-		c.listening = false
-		c.callbackRunning = true
-		c.Unlock()
-		c.server.onNewMessage(c, message)
-		c.Lock()
-		c.listening = true
-		c.callbackRunning = false
+		c.handlerCtx = ctx
 		c.Unlock()
 	}
+	ok := c.server.safely(c, func() {
+		c.server.messageHandler().ServeMessage(ctx, c, message)
+	})
+	if c.metrics != nil {
+		c.metrics.HandlerDuration(time.Since(start))
+	}
+	if span != nil {
+		if !ok {
+			span.RecordError(errors.New("handler panicked"))
+		}
+		span.End()
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.handlerCtx == ctx {
+		c.handlerCtx = nil
+	}
+	if c.listenGen != gen {
+		// The handler detached or hijacked the client, so another goroutine or the caller now owns the reader.
+		return false
+	}
+	c.listening = true
+	c.callbackRunning = false
+	return true
 }
 
-// You can call this method to stop the function executed when messages are received.
-// Exiting the goroutine yourself will cause the program to stop sending messages to your function for receiving client messages, but exiting this function will ensure messages are still received, while at the same time, exiting the goroutine.
-func (c *Client) Stop() {
+// Reports whether nothing is reading the client's messages for now, because a handler is running without a prompt, or a message is waiting to be pulled.
+// Must be called with the client locked.
+func (c *Client) readingPaused() bool {
+	return c.callbackRunning && !c.prompt || c.pulling
+}
+
+// Lets the message handler currently running continue as a background task after it returns control to the client, by starting a new goroutine to receive and dispatch the client's messages.
+// Once detached, prompts read by the handler are delivered by the new goroutine, and returning from the handler simply ends it.
+// It must be called from within a message handler, and returns an error otherwise.
+func (c *Client) Detach() error {
 	c.Lock()
-	listener := c.callbackRunning
+	if !c.connected {
+		c.Unlock()
+		return ErrNotConnected
+	}
+	if !c.callbackRunning {
+		c.Unlock()
+		return ErrNotInHandler
+	}
+	c.callbackRunning = false
 	c.Unlock()
-	if !listener {
-		return
+	c.startReading()
+	return nil
+}
+
+// Stops the server from reading the client's messages, returning the underlying connection and the buffered reader holding any data already received.
+// The client stays connected, and Send, Readln and the prompt functions can still be used, but no handlers will be called until Resume is called.
+// A client hijacked while using the server's event loop is removed from it, and has a goroutine of its own from then on.
+// It must be called from within a message handler, and returns an error otherwise.
+func (c *Client) Hijack() (net.Conn, *bufio.Reader, error) {
+	c.Lock()
+	defer c.Unlock()
+	if !c.connected {
+		return nil, nil, ErrNotConnected
 	}
-	defer func() {
-		go c.listen()
-	}()
-	runtime.Goexit()
+	if c.hijacked {
+		return nil, nil, ErrAlreadyHijacked
+	}
+	if !c.callbackRunning {
+		return nil, nil, ErrNotInHandler
+	}
+	c.hijacked = true
+	c.listenGen++
+	c.listening = false
+	c.callbackRunning = false
+	if c.lb != nil {
+		c.server.poller.remove(c)
+		c.r = bufio.NewReader(io.MultiReader(bytes.NewReader(c.lb.take()), c.conn))
+		c.lb = nil
+	}
+	return c.conn, c.r, nil
+}
+
+// Starts receiving and dispatching the client's messages again after a call to Hijack.
+// Nothing else should read from the connection or reader returned by Hijack after this is called.
+func (c *Client) Resume() error {
+	c.Lock()
+	if !c.connected {
+		c.Unlock()
+		return ErrNotConnected
+	}
+	if !c.hijacked {
+		c.Unlock()
+		return ErrNotHijacked
+	}
+	c.hijacked = false
+	c.Unlock()
+	c.startReading()
+	return nil
 }
 
-func (c *Client) readprompt(prompt string) (string, bool) {
+func (c *Client) readprompt(prompt string) (answer string, aborted bool) {
 	c.p.Lock()
 	defer c.p.Unlock()
 	c.Lock()
 	c.prompt = true
+	c.promptDone = make(chan struct{})
 	listening := c.listening
 	c.Unlock()
+	if c.metrics != nil {
+		c.metrics.Prompt()
+	}
+	if c.tracer != nil {
+		c.Lock()
+		parent := c.handlerCtx
+		c.Unlock()
+		if parent == nil {
+			parent = c.ctx
+		}
+		_, span := c.tracer.Start(parent, SpanPrompt)
+		defer func() {
+			span.SetAttributes(slog.Bool("tcp_server.prompt.aborted", aborted))
+			span.End()
+		}()
+	}
 	defer func() {
 		c.Lock()
 		c.prompt = false
+		close(c.promptDone)
 		c.Unlock()
 	}()
 	if prompt != "" {
-		sent := c.Send(prompt)
-		if !sent {
+		if c.Send(prompt) != nil {
 			return "", true
 		}
 	}
 	var str string
 	var err error
-	var ok bool
 	if !listening {
 		str, err = c.readln()
 	} else {
-		str, ok = <-c.pmsg
-		if !ok {
-			err = errors.New("prompt channel closed")
+		select {
+		case str = <-c.pmsg:
+		case <-c.done:
+			err = ErrNotConnected
 		}
 	}
 	if err != nil {
@@ -233,10 +511,11 @@ func (c *Client) ReadPromptMenu(prompt string, menu []string) (int, bool) {
 	for {
 		res = -1
 		answer, aborted = c.readprompt(prompthead + prompt + menumsg + abortmsg)
-		if !aborted {
+		if aborted {
 			return res, aborted
 		}
 		if strings.ToLower(answer) == "abort" {
+			aborted = true
 			c.Send("Aborted.")
 			break
 		}
@@ -296,20 +575,47 @@ func (c *Client) Host() string {
 	return c.host
 }
 
-// Send text message to client
-func (c *Client) Send(message string) bool {
-	message = strings.Trim(message, "\r\n") + "\r\n"
-	if message == "\r\n" {
-		return false
+// Send text message to client.
+// Returns an error if the message is empty or couldn't be sent.
+func (c *Client) Send(message string) error {
+	encoded, err := encodeMessage(message)
+	if err != nil {
+		return err
 	}
+	return c.sendEncoded(encoded)
+}
+
+// Returns the message as it is written to the connection, before its line ending.
+func encodeMessage(message string) (string, error) {
+	message = strings.Trim(message, "\r\n")
+	if message == "" {
+		return "", ErrEmptyMessage
+	}
+	return message, nil
+}
+
+// Sends a message that has already been encoded with encodeMessage.
+func (c *Client) sendEncoded(message string) error {
 	c.Lock()
-	_, wErr := c.w.WriteString(message)
-	err := c.w.Flush()
+	connected := c.connected
 	c.Unlock()
-	if err != nil || wErr != nil {
-		c.close()
+	if !connected {
+		return ErrNotConnected
 	}
-	return true
+	if c.qsize > 0 {
+		return c.enqueue(message)
+	}
+	return c.write(message)
+}
+
+func (c *Client) write(message string) error {
+	c.wl.Lock()
+	err := c.writeLine(message, true)
+	c.wl.Unlock()
+	if err != nil {
+		c.closeWithReason(CloseWriteError, err)
+	}
+	return err
 }
 
 // Send text message to all clients accept the client excluded.
@@ -331,6 +637,39 @@ func (c *Client) SendAllUnauthorized(message string, excluded *Client) (int, err
 	return c.server.SendAllUnauthorized(message, excluded)
 }
 
+// Writes a message and its line ending to the connection, through the buffered writer if the client has one, or a pooled buffer if it doesn't.
+// Must be called with c.wl locked.
+func (c *Client) writeLine(message string, flush bool) error {
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	var err error
+	if c.w == nil {
+		b := getBuffer()
+		*b = append(append((*b)[:0], message...), "\r\n"...)
+		_, err = c.conn.Write(*b)
+		putBuffer(b)
+	} else {
+		_, err = c.w.WriteString(message)
+		if err == nil {
+			_, err = c.w.WriteString("\r\n")
+		}
+		if err == nil && flush {
+			err = c.w.Flush()
+		}
+	}
+	if err == nil {
+		c.sent(message, len(message)+2)
+	}
+	return err
+}
+
+func (c *Client) isAuthorized() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.authorized
+}
+
 // Gets the client ID.
 func (c *Client) ID() int64 {
 	c.Lock()
@@ -339,31 +678,85 @@ func (c *Client) ID() int64 {
 }
 
 func (c *Client) close() error {
+	return c.closeWithReason(CloseRequested, nil)
+}
+
+// Closes the connection, recording why as the cause of the client's cancelled context, and passing it to OnClientConnectionClosed.
+// If cause is nil, the error from closing the connection is recorded instead.
+func (c *Client) closeWithReason(reason CloseReason, cause error) error {
 	var err error
 	c.Lock()
 	s := c.server
 	if c.connected {
+		if c.lb != nil {
+			s.poller.remove(c)
+		}
 		err = c.conn.Close()
 		c.connected = false
-		close(c.pmsg)
-		if c.authorized {
+		c.stopIdleTimer()
+		c.stopHeartbeat()
+		if cause == nil {
+			cause = err
+		}
+		c.closeErr = &CloseError{Reason: reason, Err: cause}
+		c.cancel(c.closeErr)
+		close(c.done)
+		c.Unlock()
+		c.closeQueue()
+		c.Lock()
+		handlers := c.handlers
+		c.handlers = nil
+		c.Unlock()
+		for i := len(handlers) - 1; i >= 0; i-- {
+			handlerExit(c, handlers[i])
+		}
+		c.leaveRooms()
+		c.releaseRateLimit()
+		c.Lock()
+		authorized := c.authorized
+		c.Unlock()
+		level := slog.LevelInfo
+		if !reason.normal() {
+			level = slog.LevelWarn
+		}
+		c.log(level, "client disconnected", slog.String("reason", reason.String()), slog.Any("error", cause))
+		c.endConnectionSpan(c.closeErr)
+		if t := c.transcript.Load(); t != nil {
+			c.record(TranscriptClose, reason.String())
+			(*t).Close()
+		}
+		if c.metrics != nil {
+			c.metrics.ConnectionClosed(reason)
+		}
+		c.Lock()
+		if authorized {
 			c.authorized = false
 			c.Unlock()
-			s.onClientConnectionClosed(c, err)
+			s.safely(c, func() {
+				s.onClientConnectionClosed(c, c.closeErr)
+			})
 			c.Lock()
 		}
 		c.Unlock()
-		s.remove(c.id)
+		s.remove(c)
 		c.DataClear()
 	} else {
-		err = errors.New("already disconnected")
+		err = ErrAlreadyDisconnected
 		c.Unlock()
 	}
 	return err
 }
 
+// Returns a context that is cancelled when the client disconnects.
+// Why it disconnected can be retrieved with context.Cause, which returns a *CloseError.
+func (c *Client) Context() context.Context {
+	return c.ctx
+}
+
 // Closes an open client connection, and calls the OnConnectionClose() callback function.
+// Messages still in the client's outbound queue are written first. See SetOutboundQueue.
 func (c *Client) Close() error {
+	c.drainQueue()
 	return c.close()
 }
 
@@ -411,30 +804,6 @@ func (c *Client) DataClear() {
 	c.db = nil
 }
 
-func stringFormatWithBS(str string) string {
-	if str == "" {
-		return ""
-	}
-	ts := ""
-	for _, chr := range str {
-		if chr == 8 {
-			if ts != "" && len(ts) > 1 {
-				ts = ts[:len(ts)-1]
-				continue
-			} else if len(ts) == 1 {
-				ts = ""
-				continue
-			}
-			continue
-		}
-		if chr < 32 || chr > 126 {
-			continue
-		}
-		ts += string(chr)
-	}
-	return ts
-}
-
 func hostCheck(host string) string {
 	return strings.TrimSuffix(host, ".")
 }
@@ -0,0 +1,122 @@
+package tcp_server
+
+import (
+	"io"
+)
+
+// CloseReason says why a client was disconnected.
+type CloseReason int
+
+const (
+	// Close or CloseWithReason was called.
+	CloseRequested CloseReason = iota
+	// The server was stopped.
+	CloseServerStopped
+	// The client closed the connection.
+	ClosePeerHungUp
+	// Reading from the connection failed.
+	CloseReadError
+	// Writing to the connection failed, or took longer than the write timeout.
+	CloseWriteError
+	// OnNewClient rejected the client.
+	CloseRejected
+	// The TLS handshake failed, or took longer than the handshake timeout.
+	CloseHandshakeFailed
+	// Nothing was received from the client within the idle timeout.
+	CloseIdleTimeout
+	// The client didn't reply to a heartbeat in time.
+	CloseHeartbeatTimeout
+	// The client's outbound queue was full, with the QueueDisconnect policy.
+	CloseQueueFull
+	// The client exceeded its rate limit too many times.
+	CloseRateLimited
+	// The client's address was banned.
+	CloseBanned
+	// A handler panicked while handling one of the client's messages.
+	ClosePanic
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseRequested:
+		return "closed"
+	case CloseServerStopped:
+		return "server stopped"
+	case ClosePeerHungUp:
+		return "peer hung up"
+	case CloseReadError:
+		return "read error"
+	case CloseWriteError:
+		return "write error"
+	case CloseRejected:
+		return "rejected"
+	case CloseHandshakeFailed:
+		return "handshake failed"
+	case CloseIdleTimeout:
+		return "idle timeout"
+	case CloseHeartbeatTimeout:
+		return "heartbeat timeout"
+	case CloseQueueFull:
+		return "outbound queue full"
+	case CloseRateLimited:
+		return "rate limit exceeded"
+	case CloseBanned:
+		return "address banned"
+	case ClosePanic:
+		return "handler panicked"
+	}
+	return "unknown"
+}
+
+// Reports whether the reason is a usual way for a client to disconnect, rather than a sign of a problem.
+func (r CloseReason) normal() bool {
+	switch r {
+	case CloseRequested, CloseServerStopped, ClosePeerHungUp, CloseRejected:
+		return true
+	}
+	return false
+}
+
+// CloseError is passed to OnClientConnectionClosed, and is the cause of the client's cancelled context.
+type CloseError struct {
+	Reason CloseReason
+	// The error that led to the disconnection, if there was one.
+	Err error
+}
+
+func (e *CloseError) Error() string {
+	if e.Err == nil {
+		return e.Reason.String()
+	}
+	return e.Reason.String() + ": " + e.Err.Error()
+}
+
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
+// Returns why the client was disconnected, or nil if it is still connected.
+func (c *Client) CloseError() *CloseError {
+	c.Lock()
+	defer c.Unlock()
+	return c.closeErr
+}
+
+// Sends message to the client, if it isn't empty, and closes the connection once it has been written, giving reason to OnClientConnectionClosed.
+// If the client has an outbound queue, the messages already in it are written first. This waits for as long as writing them takes, which can be limited with SetWriteTimeout.
+func (c *Client) CloseWithReason(reason CloseReason, message string) error {
+	if message != "" {
+		c.Send(message)
+	}
+	c.drainQueue()
+	return c.closeWithReason(reason, nil)
+}
+
+// Closes the connection after a failed read.
+func (c *Client) readFailed(err error) {
+	reason := CloseReadError
+	if err == io.EOF {
+		reason = ClosePeerHungUp
+	}
+	c.closeWithReason(reason, err)
+}
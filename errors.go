@@ -0,0 +1,67 @@
+package tcp_server
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Errors returned by the server and clients, which can be checked for with errors.Is.
+var (
+	// The client has disconnected.
+	ErrNotConnected = errors.New("client not connected")
+	// Close was called on a client that had already disconnected.
+	ErrAlreadyDisconnected = errors.New("already disconnected")
+	// The server, or the event loop, was configured after it started.
+	ErrAlreadyStarted = errors.New("already started")
+	// Accept was called after the server stopped.
+	ErrServerStopped = errors.New("server stopped")
+	// Accept was called while accept mode wasn't enabled with SetAcceptMode.
+	ErrNotAccepting = errors.New("accept mode not enabled")
+	// The message was empty once its line endings were removed.
+	ErrEmptyMessage = errors.New("empty string invalid")
+	// A broadcast was made while no clients were connected.
+	ErrNoClients = errors.New("no clients available")
+	// A broadcast reached none of the clients. It is wrapped by *BroadcastError.
+	ErrNoneSent = errors.New("sent to no clients")
+	// Detach or Hijack was called from outside a message handler.
+	ErrNotInHandler = errors.New("not called from a message handler")
+	// Hijack was called on a client that was already hijacked.
+	ErrAlreadyHijacked = errors.New("client already hijacked")
+	// Resume was called on a client that wasn't hijacked.
+	ErrNotHijacked = errors.New("client not hijacked")
+	// The client's outbound queue was full.
+	ErrQueueFull = errors.New("outbound queue full")
+	// The event loop isn't supported on this platform.
+	ErrEventLoopUnsupported = errors.New("event loop not supported on this platform")
+	// The client is already a member of the room.
+	ErrAlreadyInRoom = errors.New("already in room")
+	// The room is at its capacity.
+	ErrRoomFull = errors.New("room full")
+	// The client isn't a member of the room.
+	ErrNotInRoom = errors.New("not in room")
+	// An address or CIDR range couldn't be parsed.
+	ErrInvalidAddress = errors.New("invalid address")
+)
+
+// BroadcastError is returned by a broadcast that reached none of the clients it was sent to.
+// It wraps ErrNoneSent, and the error for each client the message couldn't be sent to.
+type BroadcastError struct {
+	// The clients the message couldn't be sent to.
+	Failures []SendResult
+}
+
+func (e *BroadcastError) Error() string {
+	if len(e.Failures) == 0 {
+		return ErrNoneSent.Error()
+	}
+	return ErrNoneSent.Error() + ", failed for " + strconv.Itoa(len(e.Failures))
+}
+
+func (e *BroadcastError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failures)+1)
+	errs = append(errs, ErrNoneSent)
+	for _, f := range e.Failures {
+		errs = append(errs, f.Err)
+	}
+	return errs
+}
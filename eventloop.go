@@ -0,0 +1,140 @@
+package tcp_server
+
+import (
+	"bytes"
+	"io"
+	"syscall"
+)
+
+// Makes the server read from plain TCP clients with a single event loop, instead of a goroutine for each client.
+// An idle client then holds no goroutine and no read or write buffers, which matters when there are a great many of them, while the callbacks and Send work exactly as before.
+// Clients using TLS always have a goroutine of their own.
+// It must be called before Start, and returns an error if the platform doesn't support it.
+func (s *Server) SetEventLoop(enabled bool) error {
+	if enabled && !eventLoopSupported {
+		return ErrEventLoopUnsupported
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.started {
+		return ErrAlreadyStarted
+	}
+	s.eventLoop = enabled
+	return nil
+}
+
+// Reports whether conn can be read from by the event loop.
+func pollable(conn interface{}) bool {
+	_, ok := conn.(syscall.Conn)
+	return ok
+}
+
+// Holds data read by the event loop until it makes up a whole line.
+// It holds no memory while there is no partial line waiting.
+type lineBuffer struct {
+	buf   []byte
+	start int
+}
+
+// Reads what is available from r once, using a pooled buffer.
+// An error is only returned if nothing was read.
+func (lb *lineBuffer) fill(r io.Reader) error {
+	b := getBuffer()
+	n, err := r.Read(*b)
+	if n > 0 {
+		if lb.start > 0 {
+			lb.buf = append(lb.buf[:0], lb.buf[lb.start:]...)
+			lb.start = 0
+		}
+		lb.buf = append(lb.buf, (*b)[:n]...)
+		err = nil
+	}
+	putBuffer(b)
+	return err
+}
+
+// Returns the next complete line, including its line ending.
+// The line is only valid until the buffer is next filled.
+func (lb *lineBuffer) next() ([]byte, bool) {
+	i := bytes.IndexByte(lb.buf[lb.start:], '\n')
+	if i < 0 {
+		lb.release()
+		return nil, false
+	}
+	line := lb.buf[lb.start : lb.start+i+1]
+	lb.start += i + 1
+	return line, true
+}
+
+// Frees the buffer if everything in it has been read.
+func (lb *lineBuffer) release() {
+	if lb.start == len(lb.buf) {
+		lb.buf = nil
+		lb.start = 0
+	}
+}
+
+// Returns everything not yet read, and empties the buffer.
+func (lb *lineBuffer) take() []byte {
+	b := lb.buf[lb.start:]
+	lb.buf = nil
+	lb.start = 0
+	return b
+}
+
+// Reads a line for a client using the event loop, waiting for more data if needed.
+func (c *Client) readPending() (string, int, error) {
+	for {
+		if line, ok := c.lb.next(); ok {
+			return sanitizeLine(line), len(line), nil
+		}
+		if err := c.lb.fill(c.conn); err != nil {
+			c.readFailed(err)
+			return "", 0, err
+		}
+	}
+}
+
+// Called when the event loop reports the client's connection is readable.
+func (c *Client) serveReadable() {
+	c.Lock()
+	gen := c.listenGen
+	c.Unlock()
+	if err := c.lb.fill(c.conn); err != nil {
+		c.readFailed(err)
+		return
+	}
+	c.servePending(gen)
+}
+
+// Handles every complete line waiting for the client, then waits for the event loop to report more data.
+func (c *Client) servePending(gen int) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.recovered(r)
+		}
+	}()
+	for {
+		line, ok := c.lb.next()
+		if !ok {
+			break
+		}
+		message := sanitizeLine(line)
+		if c.pong(message) {
+			continue
+		}
+		c.received(message, len(line))
+		if !c.dispatch(message, gen) {
+			return
+		}
+	}
+	c.Lock()
+	current := c.connected && c.listenGen == gen
+	c.Unlock()
+	if !current {
+		return
+	}
+	if err := c.server.poller.arm(c); err != nil {
+		c.closeWithReason(CloseReadError, err)
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/tech10/tcp_server
 
-go 1.15
+go 1.23
@@ -0,0 +1,56 @@
+package tcp_server
+
+import "context"
+
+// Handler responds to a message received from a client.
+// The context is cancelled when the client disconnects, and holds the message's span if the server has a Tracer.
+type Handler interface {
+	ServeMessage(ctx context.Context, c *Client, message string)
+}
+
+// HandlerFunc allows an ordinary function to be used as a Handler.
+type HandlerFunc func(ctx context.Context, c *Client, message string)
+
+// ServeMessage calls f(ctx, c, message).
+func (f HandlerFunc) ServeMessage(ctx context.Context, c *Client, message string) {
+	f(ctx, c, message)
+}
+
+// Middleware wraps a Handler with additional behaviour, such as logging, panic recovery or authorization checks.
+// It should call next.ServeMessage to pass the message on, or return without calling it to stop processing.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with the middleware given, so that the first middleware is the outermost one and is called first.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Adds middleware to the server's message handling chain.
+// Middleware is called in the order it was added, and the client's own handler, or the callback set with OnNewMessage if it has none, is always the innermost handler.
+func (s *Server) Use(middleware ...Middleware) {
+	s.Lock()
+	s.middleware = append(s.middleware, middleware...)
+	s.buildHandler()
+	s.Unlock()
+}
+
+// Must be called with the server locked.
+func (s *Server) buildHandler() {
+	fallback := s.onNewMessage
+	s.handler = Chain(HandlerFunc(func(ctx context.Context, c *Client, message string) {
+		if h := c.Handler(); h != nil {
+			h.ServeMessage(ctx, c, message)
+			return
+		}
+		fallback(c, message)
+	}), s.middleware...)
+}
+
+func (s *Server) messageHandler() Handler {
+	s.Lock()
+	defer s.Unlock()
+	return s.handler
+}
@@ -0,0 +1,168 @@
+package tcp_server
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// The telnet NOP command, which a telnet client ignores without displaying anything.
+const TelnetNOP = "\xff\xf1"
+
+// Heartbeat configures the pings the server sends to check that clients are still there.
+type Heartbeat struct {
+	// How often a ping is sent.
+	Interval time.Duration
+	// How long to wait for the pong before disconnecting the client, which defaults to Interval.
+	Timeout time.Duration
+	// The line sent as a ping, or TelnetNOP to send a telnet NOP command without a line ending.
+	Ping string
+	// The line the client must reply with. Pongs are not passed to the message handlers or prompts.
+	// If it is empty, no reply is expected, and only failing to write the ping disconnects the client.
+	Pong string
+}
+
+// Sends a ping to clients connecting from now on at the heartbeat's interval, and disconnects them if they don't reply in time.
+// No pings are sent while what a client sends is waiting to be read, such as while a message handler is running, as its pong couldn't be seen in time.
+// Set the interval to 0 to send no pings, which is the default.
+func (s *Server) SetHeartbeat(heartbeat Heartbeat) {
+	s.Lock()
+	s.heartbeat = heartbeat
+	s.Unlock()
+}
+
+// Applies TCP keepalive settings to the connections of clients connecting from now on, replacing Go's defaults.
+// See net.KeepAliveConfig for the meaning of each setting.
+func (s *Server) SetKeepAlive(config net.KeepAliveConfig) {
+	s.Lock()
+	s.keepAlive = &config
+	s.Unlock()
+}
+
+// Applies keepalive settings to conn if it is a TCP connection, or TLS over one.
+func setKeepAlive(conn net.Conn, config *net.KeepAliveConfig) {
+	if config == nil {
+		return
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetKeepAliveConfig(*config)
+	}
+}
+
+// Returns the round trip time measured by the last heartbeat the client replied to, or 0 if there hasn't been one.
+func (c *Client) RTT() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	return c.rtt
+}
+
+// Starts sending pings to the client, if the server has a heartbeat.
+func (c *Client) startHeartbeat() {
+	if c.hbConfig.Interval <= 0 {
+		return
+	}
+	c.Lock()
+	if c.connected {
+		c.hb = time.AfterFunc(c.hbConfig.Interval, c.heartbeat)
+	}
+	c.Unlock()
+}
+
+// Called by the heartbeat timer to send a ping, or to disconnect the client if the last one went unanswered.
+func (c *Client) heartbeat() {
+	c.Lock()
+	if !c.connected {
+		c.Unlock()
+		return
+	}
+	if c.hijacked || c.readingPaused() {
+		// Pongs can't be seen while something else reads the connection, or until what the client sent has been read.
+		c.awaitingPong = false
+		c.hb.Reset(c.hbConfig.Interval)
+		c.Unlock()
+		return
+	}
+	if c.awaitingPong {
+		c.Unlock()
+		c.closeWithReason(CloseHeartbeatTimeout, nil)
+		return
+	}
+	expectPong := c.hbConfig.Pong != ""
+	if expectPong {
+		c.awaitingPong = true
+		c.pingSent = time.Now()
+	}
+	c.Unlock()
+	var err error
+	if c.hbConfig.Ping == TelnetNOP {
+		err = c.writeRaw(TelnetNOP)
+	} else {
+		err = c.Send(c.hbConfig.Ping)
+	}
+	if err != nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if !c.connected {
+		return
+	}
+	if !expectPong {
+		c.hb.Reset(c.hbConfig.Interval)
+	} else if c.awaitingPong {
+		timeout := c.hbConfig.Timeout
+		if timeout <= 0 {
+			timeout = c.hbConfig.Interval
+		}
+		c.hb.Reset(timeout)
+	}
+}
+
+// Reports whether message is the reply to a ping, recording the round trip time if it is.
+func (c *Client) pong(message string) bool {
+	if c.hbConfig.Pong == "" || message != c.hbConfig.Pong {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if !c.awaitingPong {
+		// An unexpected pong is still not a message.
+		return true
+	}
+	c.awaitingPong = false
+	c.rtt = time.Since(c.pingSent)
+	next := c.hbConfig.Interval - c.rtt
+	if next < 0 {
+		next = 0
+	}
+	c.hb.Reset(next)
+	return true
+}
+
+// Stops the heartbeat timer. Must be called with the client locked.
+func (c *Client) stopHeartbeat() {
+	if c.hb != nil {
+		c.hb.Stop()
+	}
+}
+
+// Writes data to the connection as it is, with no line ending.
+func (c *Client) writeRaw(data string) error {
+	c.wl.Lock()
+	err := c.setWriteDeadline()
+	if err == nil {
+		if c.w == nil {
+			_, err = c.conn.Write([]byte(data))
+		} else if _, err = c.w.WriteString(data); err == nil {
+			err = c.w.Flush()
+		}
+	}
+	c.wl.Unlock()
+	if err != nil {
+		c.closeWithReason(CloseWriteError, err)
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+package tcp_server
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RejectReason explains why a connection was refused before a client was created for it.
+type RejectReason int
+
+const (
+	// The server already has the maximum number of clients.
+	RejectMaxClients RejectReason = iota + 1
+	// The address already has the maximum number of clients.
+	RejectMaxClientsPerIP
+	// The address's subnet already has the maximum number of clients.
+	RejectMaxClientsPerSubnet
+	// The address is denied, or isn't allowed, by the access list.
+	RejectDenied
+	// The address is banned.
+	RejectBanned
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectMaxClients:
+		return "too many clients"
+	case RejectMaxClientsPerIP:
+		return "too many clients from this address"
+	case RejectMaxClientsPerSubnet:
+		return "too many clients from this network"
+	case RejectDenied:
+		return "address denied"
+	case RejectBanned:
+		return "address banned"
+	}
+	return "unknown"
+}
+
+// How long a refused connection is given to receive the rejection message.
+const rejectWriteTimeout = time.Second
+
+// Sets the maximum number of clients connected at once. Set it to 0 to remove the limit.
+func (s *Server) SetMaxClients(n int) {
+	s.Lock()
+	s.maxClients = n
+	s.Unlock()
+}
+
+// Sets the maximum number of clients connected at once from a single IP address. Set it to 0 to remove the limit.
+func (s *Server) SetMaxClientsPerIP(n int) {
+	s.Lock()
+	s.maxClientsPerIP = n
+	s.Unlock()
+}
+
+// Sets the maximum number of clients connected at once from addresses in the same subnet, which is the first ipv4Bits of IPv4 addresses (24, for example), or the first ipv6Bits of IPv6 addresses (64, for example).
+// Set n to 0 to remove the limit.
+func (s *Server) SetMaxClientsPerSubnet(n, ipv4Bits, ipv6Bits int) {
+	s.Lock()
+	s.maxClientsPerSubnet = n
+	s.subnetBits4 = ipv4Bits
+	s.subnetBits6 = ipv6Bits
+	s.Unlock()
+}
+
+// Sets a message sent to refused connections, before they are closed.
+// Set it to an empty string to close them without a message, which is the default.
+func (s *Server) SetRejectMessage(message string) {
+	s.Lock()
+	s.rejectMessage = message
+	s.Unlock()
+}
+
+// Called when a connection is refused, before a client is created for it or OnNewClient is called.
+func (s *Server) OnConnectionRejected(callback func(addr net.Addr, reason RejectReason)) {
+	s.Lock()
+	s.onConnectionRejected = callback
+	s.Unlock()
+}
+
+// Returns the key clients from ip are counted under for the subnet limit, or an empty string if ip can't be parsed.
+func subnetKey(ip string, bits4, bits6 int) string {
+	parsed := parseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(bits4, 32)).String() + "/" + strconv.Itoa(bits4)
+	}
+	return parsed.Mask(net.CIDRMask(bits6, 128)).String() + "/" + strconv.Itoa(bits6)
+}
+
+// Checks a new connection from ip against the access list, then counts it against the limits, returning the subnet it was counted under, or the reason it must be refused.
+func (s *Server) admit(ip string) (string, RejectReason) {
+	if reason := s.AccessList().Check(ip); reason != 0 {
+		return "", reason
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.maxClients > 0 && s.connCount >= s.maxClients {
+		return "", RejectMaxClients
+	}
+	if s.maxClientsPerIP > 0 && s.ipCount[ip] >= s.maxClientsPerIP {
+		return "", RejectMaxClientsPerIP
+	}
+	subnet := ""
+	if s.maxClientsPerSubnet > 0 {
+		subnet = subnetKey(ip, s.subnetBits4, s.subnetBits6)
+		if subnet != "" && s.subnetCount[subnet] >= s.maxClientsPerSubnet {
+			return "", RejectMaxClientsPerSubnet
+		}
+	}
+	if s.ipCount == nil {
+		s.ipCount = make(map[string]int)
+		s.subnetCount = make(map[string]int)
+	}
+	s.connCount++
+	s.ipCount[ip]++
+	if subnet != "" {
+		s.subnetCount[subnet]++
+	}
+	return subnet, 0
+}
+
+// Stops counting a client admitted with admit.
+// Must be called with the server locked.
+func (s *Server) release(c *Client) {
+	if !c.admitted {
+		return
+	}
+	c.admitted = false
+	s.connCount--
+	if s.ipCount[c.ip]--; s.ipCount[c.ip] <= 0 {
+		delete(s.ipCount, c.ip)
+	}
+	if c.subnet != "" {
+		if s.subnetCount[c.subnet]--; s.subnetCount[c.subnet] <= 0 {
+			delete(s.subnetCount, c.subnet)
+		}
+	}
+}
+
+// Refuses a connection, sending it the rejection message if there is one.
+func (s *Server) reject(conn net.Conn, reason RejectReason) {
+	defer s.wg.Done()
+	s.Lock()
+	message := s.rejectMessage
+	callback := s.onConnectionRejected
+	s.Unlock()
+	if m := s.getMetrics(); m != nil {
+		m.ConnectionRejected(reason)
+	}
+	s.log(slog.LevelWarn, "connection rejected", slog.String("addr", conn.RemoteAddr().String()), slog.String("reason", reason.String()))
+	if callback != nil {
+		s.safely(nil, func() {
+			callback(conn.RemoteAddr(), reason)
+		})
+	}
+	if message, err := encodeMessage(message); err == nil {
+		conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+		conn.Write([]byte(message + "\r\n"))
+	}
+	conn.Close()
+}
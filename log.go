@@ -0,0 +1,57 @@
+package tcp_server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Sets the handler the server logs its events to, such as clients connecting, being rejected or disconnecting, panics in handlers, and protocol errors.
+// Events about a client carry its ID and IP address, and every event carries the listener's address, as attributes.
+// Set it to nil to log to slog's default logger, which is the default.
+func (s *Server) SetLogger(handler slog.Handler) {
+	s.Lock()
+	s.logHandler = handler
+	s.Unlock()
+}
+
+// Sets the lowest level of event that is logged, in addition to any level set on the handler itself.
+// Set it to nil to log every level when a handler has been set with SetLogger, and only errors when logging to slog's default logger, which is the default.
+func (s *Server) SetLogLevel(level slog.Leveler) {
+	s.Lock()
+	s.logLevel = level
+	s.Unlock()
+}
+
+// Logs an event with the listener's address and the given attributes.
+func (s *Server) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	s.Lock()
+	handler := s.logHandler
+	min := s.logLevel
+	s.Unlock()
+	listener := s.listenerName()
+	if min == nil {
+		min = slog.LevelDebug
+		if handler == nil {
+			min = slog.LevelError
+		}
+	}
+	if handler == nil {
+		handler = slog.Default().Handler()
+	}
+	ctx := context.Background()
+	if level < min.Level() || !handler.Enabled(ctx, level) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	r.AddAttrs(slog.String("listener", listener))
+	r.AddAttrs(attrs...)
+	handler.Handle(ctx, r)
+}
+
+// Logs an event about the client, with its ID and IP address.
+// Must not be called with the client locked.
+func (c *Client) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	attrs = append([]slog.Attr{slog.Int64("client", c.ID()), slog.String("ip", c.ip)}, attrs...)
+	c.server.log(level, msg, attrs...)
+}
@@ -0,0 +1,232 @@
+package tcp_server
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives counts of what the server does. Its methods are called concurrently, and from the paths that handle every message, so they must be safe for concurrent use and quick.
+type Metrics interface {
+	// Called when a connection is accepted, before OnNewClient is called.
+	ConnectionAccepted()
+	// Called when a connection is refused before a client is made for it.
+	ConnectionRejected(reason RejectReason)
+	// Called when a client accepted with ConnectionAccepted disconnects.
+	ConnectionClosed(reason CloseReason)
+	// Called for each line received, other than replies to heartbeats, with its length on the wire.
+	MessageReceived(bytes int)
+	// Called for each line written, with its length on the wire.
+	MessageSent(bytes int)
+	// Called after a broadcast, with the number of clients it was sent to.
+	Broadcast(recipients int)
+	// Called after a message handler returns, with how long it ran for.
+	HandlerDuration(d time.Duration)
+	// Called when a prompt is shown to a client.
+	Prompt()
+}
+
+// Reports what the server does to m from now on. Clients that are already connected aren't counted.
+// Set m to nil to stop collecting metrics, which is the default.
+func (s *Server) SetMetrics(m Metrics) {
+	s.Lock()
+	s.metrics = m
+	s.Unlock()
+}
+
+func (s *Server) getMetrics() Metrics {
+	s.Lock()
+	defer s.Unlock()
+	return s.metrics
+}
+
+// The upper bounds, in seconds, of the handler duration histogram's buckets.
+var handlerDurationBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics is the standard implementation of Metrics, which serves its metrics over HTTP in the Prometheus text format.
+type PrometheusMetrics struct {
+	accepted         atomic.Int64
+	active           atomic.Int64
+	messagesReceived atomic.Int64
+	bytesReceived    atomic.Int64
+	messagesSent     atomic.Int64
+	bytesSent        atomic.Int64
+	broadcasts       atomic.Int64
+	recipients       atomic.Int64
+	prompts          atomic.Int64
+	handlerCount     atomic.Int64
+	handlerNanos     atomic.Int64
+	handlerBuckets   []atomic.Int64
+	l                sync.Mutex
+	rejected         map[string]int64
+	closed           map[string]int64
+}
+
+// Creates metrics to give to SetMetrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		handlerBuckets: make([]atomic.Int64, len(handlerDurationBuckets)),
+		rejected:       make(map[string]int64),
+		closed:         make(map[string]int64),
+	}
+}
+
+func (m *PrometheusMetrics) ConnectionAccepted() {
+	m.accepted.Add(1)
+	m.active.Add(1)
+}
+
+func (m *PrometheusMetrics) ConnectionRejected(reason RejectReason) {
+	m.l.Lock()
+	m.rejected[reason.String()]++
+	m.l.Unlock()
+}
+
+func (m *PrometheusMetrics) ConnectionClosed(reason CloseReason) {
+	m.active.Add(-1)
+	m.l.Lock()
+	m.closed[reason.String()]++
+	m.l.Unlock()
+}
+
+func (m *PrometheusMetrics) MessageReceived(bytes int) {
+	m.messagesReceived.Add(1)
+	m.bytesReceived.Add(int64(bytes))
+}
+
+func (m *PrometheusMetrics) MessageSent(bytes int) {
+	m.messagesSent.Add(1)
+	m.bytesSent.Add(int64(bytes))
+}
+
+func (m *PrometheusMetrics) Broadcast(recipients int) {
+	m.broadcasts.Add(1)
+	m.recipients.Add(int64(recipients))
+}
+
+func (m *PrometheusMetrics) HandlerDuration(d time.Duration) {
+	m.handlerCount.Add(1)
+	m.handlerNanos.Add(int64(d))
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(handlerDurationBuckets, seconds)
+	if i < len(m.handlerBuckets) {
+		m.handlerBuckets[i].Add(1)
+	}
+}
+
+func (m *PrometheusMetrics) Prompt() {
+	m.prompts.Add(1)
+}
+
+// Writes the metrics in the Prometheus text format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var b strings.Builder
+	writeMetric(&b, "tcp_server_connections_accepted_total", "counter", "Connections accepted.", m.accepted.Load())
+	m.l.Lock()
+	writeLabelled(&b, "tcp_server_connections_rejected_total", "Connections refused, by reason.", m.rejected)
+	writeLabelled(&b, "tcp_server_connections_closed_total", "Clients disconnected, by reason.", m.closed)
+	m.l.Unlock()
+	writeMetric(&b, "tcp_server_connections_active", "gauge", "Clients currently connected.", m.active.Load())
+	writeMetric(&b, "tcp_server_messages_received_total", "counter", "Lines received from clients.", m.messagesReceived.Load())
+	writeMetric(&b, "tcp_server_received_bytes_total", "counter", "Bytes of lines received from clients.", m.bytesReceived.Load())
+	writeMetric(&b, "tcp_server_messages_sent_total", "counter", "Lines written to clients.", m.messagesSent.Load())
+	writeMetric(&b, "tcp_server_sent_bytes_total", "counter", "Bytes of lines written to clients.", m.bytesSent.Load())
+	writeMetric(&b, "tcp_server_broadcasts_total", "counter", "Broadcasts made.", m.broadcasts.Load())
+	writeMetric(&b, "tcp_server_broadcast_recipients_total", "counter", "Clients broadcasts were sent to.", m.recipients.Load())
+	writeMetric(&b, "tcp_server_prompts_total", "counter", "Prompts shown to clients.", m.prompts.Load())
+	name := "tcp_server_handler_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time spent in message handlers.\n# TYPE %s histogram\n", name, name)
+	var cumulative int64
+	for i, le := range handlerDurationBuckets {
+		cumulative += m.handlerBuckets[i].Load()
+		fmt.Fprintf(&b, "%s_bucket{le=\"%g\"} %d\n", name, le, cumulative)
+	}
+	fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", name, m.handlerCount.Load())
+	fmt.Fprintf(&b, "%s_sum %g\n", name, time.Duration(m.handlerNanos.Load()).Seconds())
+	fmt.Fprintf(&b, "%s_count %d\n", name, m.handlerCount.Load())
+	w.Write([]byte(b.String()))
+}
+
+func writeMetric(b *strings.Builder, name, kind, help string, value int64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// Writes a counter with a value for each reason, in order of the reasons.
+func writeLabelled(b *strings.Builder, name, help string, values map[string]int64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	reasons := make([]string, 0, len(values))
+	for reason := range values {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(b, "%s{reason=%q} %d\n", name, reason, values[reason])
+	}
+}
+
+// ExpvarMetrics is an implementation of Metrics that publishes its counts in an expvar.Map.
+type ExpvarMetrics struct {
+	m        *expvar.Map
+	rejected *expvar.Map
+	closed   *expvar.Map
+	handler  *expvar.Float
+}
+
+// Creates metrics that keep their counts in m, such as a map made with expvar.NewMap, to give to SetMetrics.
+// Rejections and disconnections are counted by reason in the maps "connections_rejected" and "connections_closed" within it.
+func NewExpvarMetrics(m *expvar.Map) *ExpvarMetrics {
+	e := &ExpvarMetrics{
+		m:        m,
+		rejected: new(expvar.Map).Init(),
+		closed:   new(expvar.Map).Init(),
+		handler:  new(expvar.Float),
+	}
+	m.Set("connections_rejected", e.rejected)
+	m.Set("connections_closed", e.closed)
+	m.Set("handler_seconds", e.handler)
+	return e
+}
+
+func (e *ExpvarMetrics) ConnectionAccepted() {
+	e.m.Add("connections_accepted", 1)
+	e.m.Add("connections_active", 1)
+}
+
+func (e *ExpvarMetrics) ConnectionRejected(reason RejectReason) {
+	e.rejected.Add(reason.String(), 1)
+}
+
+func (e *ExpvarMetrics) ConnectionClosed(reason CloseReason) {
+	e.m.Add("connections_active", -1)
+	e.closed.Add(reason.String(), 1)
+}
+
+func (e *ExpvarMetrics) MessageReceived(bytes int) {
+	e.m.Add("messages_received", 1)
+	e.m.Add("received_bytes", int64(bytes))
+}
+
+func (e *ExpvarMetrics) MessageSent(bytes int) {
+	e.m.Add("messages_sent", 1)
+	e.m.Add("sent_bytes", int64(bytes))
+}
+
+func (e *ExpvarMetrics) Broadcast(recipients int) {
+	e.m.Add("broadcasts", 1)
+	e.m.Add("broadcast_recipients", int64(recipients))
+}
+
+func (e *ExpvarMetrics) HandlerDuration(d time.Duration) {
+	e.m.Add("handler_calls", 1)
+	e.handler.Add(d.Seconds())
+}
+
+func (e *ExpvarMetrics) Prompt() {
+	e.m.Add("prompts", 1)
+}
@@ -0,0 +1,104 @@
+package tcp_server
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+// PanicPolicy decides what happens after a callback, handler or hook panics.
+type PanicPolicy int
+
+const (
+	// Disconnect the client the callback was called for.
+	PanicClose PanicPolicy = iota
+	// Keep the client connected, carrying on as though the callback had returned.
+	// A client is still rejected if OnNewClient panics.
+	PanicContinue
+	// Panic again, crashing the program as though the panic had never been recovered.
+	PanicCrash
+)
+
+func (p PanicPolicy) String() string {
+	switch p {
+	case PanicClose:
+		return "close"
+	case PanicContinue:
+		return "continue"
+	case PanicCrash:
+		return "crash"
+	}
+	return "unknown"
+}
+
+// Sets what happens after a callback, message handler or hook panics.
+// It doesn't apply to AccessList.OnReload, as an access list can be shared between servers.
+// The default is PanicClose.
+func (s *Server) SetPanicPolicy(policy PanicPolicy) {
+	s.Lock()
+	s.panicPolicy = policy
+	s.Unlock()
+}
+
+// Called when a callback, message handler or hook panics, before the panic policy is applied.
+// c is the client the callback was called for, or nil if there wasn't one, and stack is the stack of the goroutine that panicked.
+func (s *Server) OnPanic(callback func(c *Client, recovered any, stack []byte)) {
+	s.Lock()
+	s.onPanic = callback
+	s.Unlock()
+}
+
+// Carries a panic that is being passed on by the PanicCrash policy, so that it isn't handled again on its way up the stack.
+type repanic struct {
+	value any
+	stack []byte
+}
+
+func (p *repanic) Error() string {
+	return fmt.Sprint(p.value) + "\n\n" + string(p.stack)
+}
+
+// Calls fn, recovering from a panic in it according to the panic policy.
+// c is the client fn is called for, or nil. Returns false if fn panicked.
+func (s *Server) safely(c *Client, fn func()) (ok bool) {
+	defer s.recoverPanic(c)
+	fn()
+	return true
+}
+
+// Deferred around callbacks to recover from a panic in them according to the panic policy.
+func (s *Server) recoverPanic(c *Client) {
+	if r := recover(); r != nil {
+		s.panicked(c, r)
+	}
+}
+
+// Reports a recovered panic, and applies the panic policy.
+func (s *Server) panicked(c *Client, r any) {
+	if p, ok := r.(*repanic); ok {
+		panic(p)
+	}
+	stack := debug.Stack()
+	s.Lock()
+	policy := s.panicPolicy
+	callback := s.onPanic
+	s.Unlock()
+	attrs := []slog.Attr{slog.Any("panic", r), slog.String("policy", policy.String()), slog.String("stack", string(stack))}
+	if c != nil {
+		c.log(slog.LevelError, "callback panicked", attrs...)
+	} else {
+		s.log(slog.LevelError, "callback panicked", attrs...)
+	}
+	if callback != nil {
+		callback(c, r, stack)
+	}
+	switch policy {
+	case PanicContinue:
+	case PanicCrash:
+		panic(&repanic{value: r, stack: stack})
+	default:
+		if c != nil {
+			c.closeWithReason(ClosePanic, fmt.Errorf("%v", r))
+		}
+	}
+}
@@ -0,0 +1,149 @@
+//go:build linux
+
+package tcp_server
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+)
+
+const eventLoopSupported = true
+
+// An epoll instance reporting when clients' connections become readable.
+// Connections are registered one shot, so that only one goroutine reads from a client at a time, and are armed again once everything read has been handled.
+type poller struct {
+	fd      int
+	wake    [2]int
+	mu      sync.Mutex
+	clients map[int32]*Client
+	closed  bool
+}
+
+func newPoller() (*poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &poller{
+		fd:      fd,
+		clients: make(map[int32]*Client),
+	}
+	// Closing the poller writes to this pipe, to wake the event loop.
+	if err = syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wake[0])}
+	if err = syscall.EpollCtl(fd, syscall.EPOLL_CTL_ADD, p.wake[0], &ev); err != nil {
+		syscall.Close(p.wake[0])
+		syscall.Close(p.wake[1])
+		syscall.Close(fd)
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *poller) event(c *Client) *syscall.EpollEvent {
+	return &syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     int32(c.fd),
+	}
+}
+
+// Registers a client. Its connection isn't waited for until it is armed, so that anything already read for it can be handled first.
+func (p *poller) add(c *Client) error {
+	sc, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return errors.New("connection not pollable")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	err = raw.Control(func(fd uintptr) {
+		c.fd = int(fd)
+	})
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("event loop closed")
+	}
+	p.clients[int32(c.fd)] = c
+	return nil
+}
+
+// Starts waiting for a registered client's connection to become readable, once.
+func (p *poller) arm(c *Client) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.clients[int32(c.fd)] != c {
+		return errors.New("client not registered with the event loop")
+	}
+	err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, c.fd, p.event(c))
+	if err == syscall.ENOENT {
+		// Armed for the first time.
+		err = syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, c.fd, p.event(c))
+	}
+	return err
+}
+
+// Unregisters a client. This must happen before its connection is closed, as the descriptor may be reused straight away.
+func (p *poller) remove(c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.clients[int32(c.fd)] != c {
+		return
+	}
+	delete(p.clients, int32(c.fd))
+	syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+}
+
+// Runs the event loop until the poller is closed.
+func (p *poller) run() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.fd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			p.shutdown()
+			return
+		}
+		for i := 0; i < n; i++ {
+			fd := events[i].Fd
+			if int(fd) == p.wake[0] {
+				p.shutdown()
+				return
+			}
+			p.mu.Lock()
+			c := p.clients[fd]
+			p.mu.Unlock()
+			if c != nil {
+				go c.serveReadable()
+			}
+		}
+	}
+}
+
+// Stops the event loop.
+func (p *poller) close() {
+	syscall.Write(p.wake[1], []byte{0})
+}
+
+func (p *poller) shutdown() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.clients = nil
+	syscall.Close(p.fd)
+	syscall.Close(p.wake[0])
+	syscall.Close(p.wake[1])
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package tcp_server
+
+const eventLoopSupported = false
+
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, ErrEventLoopUnsupported
+}
+
+func (p *poller) add(c *Client) error {
+	return ErrEventLoopUnsupported
+}
+
+func (p *poller) arm(c *Client) error {
+	return ErrEventLoopUnsupported
+}
+
+func (p *poller) remove(c *Client) {}
+
+func (p *poller) run() {}
+
+func (p *poller) close() {}
@@ -0,0 +1,75 @@
+package tcp_server
+
+import (
+	"context"
+)
+
+// Message is a line of text received from a client, as delivered by Client.Messages.
+type Message struct {
+	Client *Client
+	Text   string
+}
+
+// Sets whether clients are received with Accept, as an alternative to handling them with callbacks.
+// While enabled, every client accepted by the OnNewClient callback, or every client if no callback is set, is held until it is returned by Accept, and its messages are delivered through Client.Messages instead of the message handlers.
+// Disabling it hands the clients still waiting to be accepted to the message handlers, and makes waiting calls to Accept return ErrNotAccepting.
+func (s *Server) SetAcceptMode(enabled bool) {
+	s.Lock()
+	defer s.Unlock()
+	if enabled == s.pull {
+		return
+	}
+	s.pull = enabled
+	if enabled {
+		s.pullOff = make(chan struct{})
+	} else {
+		close(s.pullOff)
+	}
+}
+
+// Returns the next client accepted by the server, while accept mode is enabled with SetAcceptMode.
+// Clients that disconnect before they are returned are skipped.
+// Returns an error when ctx is done, the server is stopped, or accept mode is disabled.
+func (s *Server) Accept(ctx context.Context) (*Client, error) {
+	s.Lock()
+	pull := s.pull
+	pullOff := s.pullOff
+	s.Unlock()
+	if !pull {
+		return nil, ErrNotAccepting
+	}
+	for {
+		select {
+		case c := <-s.acceptq:
+			select {
+			case <-c.done:
+				continue
+			default:
+			}
+			return c, nil
+		case <-pullOff:
+			return nil, ErrNotAccepting
+		case <-s.done:
+			return nil, ErrServerStopped
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Returns a channel delivering the messages received from the client.
+// Once this has been called, messages are no longer passed to the message handlers, though prompts still take priority.
+// The channel is never closed. Use Done to find out when the client disconnects.
+func (c *Client) Messages() <-chan Message {
+	c.Lock()
+	defer c.Unlock()
+	if c.msgs == nil {
+		c.msgs = make(chan Message)
+	}
+	return c.msgs
+}
+
+// Returns a channel that is closed when the client disconnects.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
@@ -0,0 +1,163 @@
+package tcp_server
+
+import (
+	"sync"
+	"time"
+)
+
+// QueuePolicy decides what happens when a message is sent to a client whose outbound queue is full.
+type QueuePolicy int
+
+const (
+	// Wait until there is room in the queue, or the client disconnects.
+	QueueBlock QueuePolicy = iota
+	// Discard the oldest message in the queue to make room for the new one.
+	QueueDropOldest
+	// Discard the new message, and return an error from Send.
+	QueueDropNewest
+	// Disconnect the client, as it isn't keeping up.
+	QueueDisconnect
+)
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case QueueBlock:
+		return "block"
+	case QueueDropOldest:
+		return "drop oldest"
+	case QueueDropNewest:
+		return "drop newest"
+	case QueueDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// Gives each client connecting from now on an outbound queue holding up to size messages, which is written to the connection by a separate goroutine so that sending to a slow client doesn't hold up the sender.
+// The policy decides what happens when the queue is full.
+// Closing a client waits for its queue to be written first, for up to the write timeout, or five seconds if none is set.
+// Set size to 0 to write messages as they are sent, which is the default.
+func (s *Server) SetOutboundQueue(size int, policy QueuePolicy) {
+	s.Lock()
+	s.queueSize = size
+	s.queuePolicy = policy
+	s.Unlock()
+}
+
+// Returns the number of messages waiting in the client's outbound queue.
+func (c *Client) QueueLen() int {
+	if c.qsize == 0 {
+		return 0
+	}
+	c.q.Lock()
+	defer c.q.Unlock()
+	return len(c.queue)
+}
+
+func (c *Client) initQueue(size int, policy QueuePolicy) {
+	if size <= 0 {
+		return
+	}
+	c.qsize = size
+	c.qpolicy = policy
+	c.qcond = sync.NewCond(&c.q)
+}
+
+func (c *Client) enqueue(message string) error {
+	c.q.Lock()
+	for !c.qclosed && len(c.queue) >= c.qsize {
+		switch c.qpolicy {
+		case QueueDropOldest:
+			c.queue[0] = ""
+			c.queue = c.queue[1:]
+		case QueueDropNewest:
+			c.q.Unlock()
+			return ErrQueueFull
+		case QueueDisconnect:
+			c.q.Unlock()
+			c.closeWithReason(CloseQueueFull, nil)
+			return ErrQueueFull
+		default:
+			c.qcond.Wait()
+		}
+	}
+	if c.qclosed {
+		c.q.Unlock()
+		return ErrNotConnected
+	}
+	c.queue = append(c.queue, message)
+	if !c.writing {
+		c.writing = true
+		go c.writeQueue()
+	}
+	c.q.Unlock()
+	return nil
+}
+
+// Writes queued messages until the queue is empty, flushing the connection whenever there is nothing more to write.
+func (c *Client) writeQueue() {
+	for {
+		c.q.Lock()
+		if c.qclosed || len(c.queue) == 0 {
+			c.writing = false
+			c.qcond.Broadcast()
+			c.q.Unlock()
+			return
+		}
+		message := c.queue[0]
+		c.queue[0] = ""
+		c.queue = c.queue[1:]
+		more := len(c.queue) > 0
+		c.qcond.Broadcast()
+		c.q.Unlock()
+		c.wl.Lock()
+		err := c.writeLine(message, !more)
+		c.wl.Unlock()
+		if err != nil {
+			c.closeWithReason(CloseWriteError, err)
+			c.q.Lock()
+			c.writing = false
+			c.q.Unlock()
+			return
+		}
+	}
+}
+
+// How long closing a client waits for its queue to be written when no write timeout is set.
+const drainTimeout = 5 * time.Second
+
+// Waits until everything in the queue has been written, the client disconnects, or the write timeout passes, or drainTimeout if none is set.
+func (c *Client) drainQueue() {
+	if c.qsize == 0 {
+		return
+	}
+	timeout := c.writeTimeout
+	if timeout <= 0 {
+		timeout = drainTimeout
+	}
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		c.q.Lock()
+		expired = true
+		c.qcond.Broadcast()
+		c.q.Unlock()
+	})
+	defer timer.Stop()
+	c.q.Lock()
+	for !expired && !c.qclosed && (len(c.queue) > 0 || c.writing) {
+		c.qcond.Wait()
+	}
+	c.q.Unlock()
+}
+
+// Discards the queue and wakes anything waiting for room in it.
+func (c *Client) closeQueue() {
+	if c.qsize == 0 {
+		return
+	}
+	c.q.Lock()
+	c.qclosed = true
+	c.queue = nil
+	c.qcond.Broadcast()
+	c.q.Unlock()
+}
@@ -0,0 +1,310 @@
+package tcp_server
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit limits how quickly messages may be received, as token buckets refilled continuously.
+// A zero rate leaves that part of the limit unset, and a zero burst allows one second's worth of the rate at once.
+// A message is always allowed when its bucket is full, so that messages longer than the byte burst aren't refused forever.
+type RateLimit struct {
+	// Messages allowed per second, and how many may arrive at once.
+	Messages     float64
+	MessageBurst int
+	// Bytes allowed per second, and how many may arrive at once.
+	Bytes     float64
+	ByteBurst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Messages > 0 || l.Bytes > 0
+}
+
+// RateLimitPolicy decides what happens to a message received over the rate limit.
+// The actions escalate: a message is delayed if it can be, dropped if it can't, and the client is disconnected after too many messages are dropped.
+type RateLimitPolicy struct {
+	// The longest a message is held back until the limit allows it. Messages needing longer are dropped.
+	MaxDelay time.Duration
+	// Sent to the client when one of its messages is dropped, unless it is empty.
+	Warning string
+	// Disconnects the client once this many of its messages have been dropped since one was last allowed straight away. Set it to 0 to never disconnect.
+	DisconnectAfter int
+}
+
+// RateLimitAction is what was done about a message over the rate limit.
+type RateLimitAction int
+
+const (
+	RateLimitDelayed RateLimitAction = iota + 1
+	RateLimitDropped
+	RateLimitDisconnected
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDelayed:
+		return "delayed"
+	case RateLimitDropped:
+		return "dropped"
+	case RateLimitDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// RateLimitEvent reports a message received over the rate limit.
+type RateLimitEvent struct {
+	Action RateLimitAction
+	// Set if the per-IP limit was the one exceeded, rather than the client's own.
+	PerIP bool
+	// How long the message was held back, or would have had to be.
+	Delay time.Duration
+	// How many messages have been dropped since one was last allowed straight away.
+	Strikes int
+}
+
+// Limits how quickly each client may send messages.
+func (s *Server) SetClientRateLimit(limit RateLimit) {
+	s.Lock()
+	s.clientRateLimit = limit
+	s.Unlock()
+}
+
+// Limits how quickly the clients connected from each IP address may send messages, between them.
+func (s *Server) SetIPRateLimit(limit RateLimit) {
+	s.Lock()
+	s.ipRateLimit = limit
+	s.Unlock()
+}
+
+// Sets what happens to messages received over the rate limits.
+func (s *Server) SetRateLimitPolicy(policy RateLimitPolicy) {
+	s.Lock()
+	s.rateLimitPolicy = policy
+	s.Unlock()
+}
+
+// Called when a message is received over a rate limit, before the action is taken.
+func (s *Server) OnRateLimited(callback func(c *Client, ev RateLimitEvent)) {
+	s.Lock()
+	s.onRateLimited = callback
+	s.Unlock()
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	b = math.Max(b, 1)
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+// Returns how long it will be until n tokens are available.
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= n || b.tokens >= b.burst {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Takes n tokens, leaving the bucket in debt if there aren't enough.
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// A message and byte bucket pair for one RateLimit.
+type limiter struct {
+	sync.Mutex
+	limit    RateLimit
+	messages *tokenBucket
+	bytes    *tokenBucket
+	refs     int
+}
+
+func newLimiter(limit RateLimit, now time.Time) *limiter {
+	return &limiter{
+		limit:    limit,
+		messages: newTokenBucket(limit.Messages, limit.MessageBurst, now),
+		bytes:    newTokenBucket(limit.Bytes, limit.ByteBurst, now),
+	}
+}
+
+// Must be called with l locked.
+func (l *limiter) wait(size int, now time.Time) time.Duration {
+	return durationMax(l.messages.wait(1, now), l.bytes.wait(float64(size), now))
+}
+
+// Must be called with l locked.
+func (l *limiter) take(size int) {
+	l.messages.take(1)
+	l.bytes.take(float64(size))
+}
+
+func durationMax(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Returns the limiter shared by the clients connected from ip, creating it if needed.
+// Must be called with the server locked.
+func (s *Server) ipLimiter(ip string, limit RateLimit, now time.Time) *limiter {
+	if s.ipLimiters == nil {
+		s.ipLimiters = make(map[string]*limiter)
+	}
+	l := s.ipLimiters[ip]
+	if l == nil || l.limit != limit {
+		l = newLimiter(limit, now)
+		s.ipLimiters[ip] = l
+	}
+	l.refs++
+	return l
+}
+
+// Stops the client sharing the limiter for its IP address.
+func (c *Client) releaseRateLimit() {
+	c.rl.Lock()
+	l := c.ipLimiter
+	c.ipLimiter = nil
+	c.rl.Unlock()
+	if l == nil {
+		return
+	}
+	s := c.server
+	s.Lock()
+	if l.refs--; l.refs <= 0 && s.ipLimiters[c.ip] == l {
+		delete(s.ipLimiters, c.ip)
+	}
+	s.Unlock()
+}
+
+// Applies the rate limits to a message received, waiting if it is delayed.
+// Returns false if the message must not be handled.
+func (c *Client) allowMessage(message string) bool {
+	s := c.server
+	s.Lock()
+	clientLimit := s.clientRateLimit
+	ipLimit := s.ipRateLimit
+	policy := s.rateLimitPolicy
+	callback := s.onRateLimited
+	s.Unlock()
+	if !clientLimit.enabled() && !ipLimit.enabled() {
+		return true
+	}
+	now := time.Now()
+	c.updateLimiters(clientLimit, ipLimit, now)
+	ev := c.checkRateLimit(len(message), policy, now)
+	if ev.Action == 0 {
+		return true
+	}
+	if callback != nil {
+		c.server.safely(c, func() {
+			callback(c, ev)
+		})
+	}
+	if ev.Action == RateLimitDelayed {
+		select {
+		case <-time.After(ev.Delay):
+		case <-c.done:
+		}
+		return true
+	}
+	c.log(slog.LevelWarn, "rate limit exceeded", slog.String("action", ev.Action.String()), slog.Bool("per_ip", ev.PerIP), slog.Int("strikes", ev.Strikes))
+	if policy.Warning != "" {
+		c.Send(policy.Warning)
+	}
+	c.ReportFailure(FailureRateLimit)
+	if ev.Action == RateLimitDisconnected {
+		c.closeWithReason(CloseRateLimited, nil)
+	}
+	return false
+}
+
+// Replaces the client's limiters if the limits have changed since they were made.
+func (c *Client) updateLimiters(clientLimit, ipLimit RateLimit, now time.Time) {
+	c.rl.Lock()
+	if !clientLimit.enabled() {
+		c.limiter = nil
+	} else if c.limiter == nil || c.limiter.limit != clientLimit {
+		c.limiter = newLimiter(clientLimit, now)
+	}
+	stale := c.ipLimiter != nil && c.ipLimiter.limit != ipLimit
+	c.rl.Unlock()
+	if stale {
+		c.releaseRateLimit()
+	}
+	if !ipLimit.enabled() {
+		return
+	}
+	c.rl.Lock()
+	defer c.rl.Unlock()
+	if c.ipLimiter == nil {
+		c.server.Lock()
+		c.ipLimiter = c.server.ipLimiter(c.ip, ipLimit, now)
+		c.server.Unlock()
+	}
+}
+
+// Decides what to do with a message of size bytes, taking its tokens unless it is dropped.
+// Returns an event with no action if the message is allowed straight away.
+func (c *Client) checkRateLimit(size int, policy RateLimitPolicy, now time.Time) RateLimitEvent {
+	c.rl.Lock()
+	defer c.rl.Unlock()
+	var ev RateLimitEvent
+	if c.limiter != nil {
+		ev.Delay = c.limiter.wait(size, now)
+	}
+	ipl := c.ipLimiter
+	if ipl != nil {
+		ipl.Lock()
+		defer ipl.Unlock()
+		if wait := ipl.wait(size, now); wait > ev.Delay {
+			ev.Delay = wait
+			ev.PerIP = true
+		}
+	}
+	if ev.Delay > policy.MaxDelay {
+		c.strikes++
+		ev.Strikes = c.strikes
+		ev.Action = RateLimitDropped
+		if policy.DisconnectAfter > 0 && c.strikes >= policy.DisconnectAfter {
+			ev.Action = RateLimitDisconnected
+		}
+		return ev
+	}
+	if c.limiter != nil {
+		c.limiter.take(size)
+	}
+	if ipl != nil {
+		ipl.take(size)
+	}
+	if ev.Delay == 0 {
+		c.strikes = 0
+		return ev
+	}
+	ev.Action = RateLimitDelayed
+	ev.Strikes = c.strikes
+	return ev
+}
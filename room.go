@@ -0,0 +1,238 @@
+package tcp_server
+
+import (
+	"sort"
+	"sync"
+)
+
+// Room is a named group of clients that messages can be sent to together.
+// Clients are removed from every room they are in when they disconnect.
+type Room struct {
+	sync.Mutex
+	name     string
+	server   *Server
+	members  map[float64]*Client
+	topic    string
+	capacity int
+	onJoin   func(r *Room, c *Client)
+	onLeave  func(r *Room, c *Client)
+}
+
+// Returns the room with the given name, creating it if it doesn't exist.
+func (s *Server) Room(name string) *Room {
+	s.Lock()
+	defer s.Unlock()
+	if s.rooms == nil {
+		s.rooms = make(map[string]*Room)
+	}
+	r, exists := s.rooms[name]
+	if !exists {
+		r = &Room{
+			name:    name,
+			server:  s,
+			members: make(map[float64]*Client),
+		}
+		s.rooms[name] = r
+	}
+	return r
+}
+
+// Returns every room, sorted by name.
+func (s *Server) Rooms() []*Room {
+	s.Lock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, r := range s.rooms {
+		rooms = append(rooms, r)
+	}
+	s.Unlock()
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].name < rooms[j].name
+	})
+	return rooms
+}
+
+// Removes every client from the room, then deletes it from the server.
+// Returns false if the room doesn't exist.
+func (s *Server) RemoveRoom(name string) bool {
+	s.Lock()
+	r, exists := s.rooms[name]
+	delete(s.rooms, name)
+	s.Unlock()
+	if !exists {
+		return false
+	}
+	for _, c := range r.Members() {
+		r.Leave(c)
+	}
+	return true
+}
+
+// Returns the name of the room.
+func (r *Room) Name() string {
+	return r.name
+}
+
+// Returns the room topic.
+func (r *Room) Topic() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.topic
+}
+
+// Sets the room topic.
+func (r *Room) SetTopic(topic string) {
+	r.Lock()
+	r.topic = topic
+	r.Unlock()
+}
+
+// Returns the maximum number of clients allowed in the room, or 0 if there is no limit.
+func (r *Room) Capacity() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.capacity
+}
+
+// Sets the maximum number of clients allowed in the room. Set it to 0 to remove the limit.
+// Clients already in the room aren't removed if there are more of them than the new limit allows.
+func (r *Room) SetCapacity(capacity int) {
+	r.Lock()
+	r.capacity = capacity
+	r.Unlock()
+}
+
+// Called after a client joins the room.
+func (r *Room) OnJoin(callback func(r *Room, c *Client)) {
+	r.Lock()
+	r.onJoin = callback
+	r.Unlock()
+}
+
+// Called after a client leaves the room, including when it disconnects.
+func (r *Room) OnLeave(callback func(r *Room, c *Client)) {
+	r.Lock()
+	r.onLeave = callback
+	r.Unlock()
+}
+
+// Adds a client to the room.
+// Returns an error if the client is disconnected, already in the room, or the room is full.
+func (r *Room) Join(c *Client) error {
+	r.Lock()
+	if _, exists := r.members[c.id]; exists {
+		r.Unlock()
+		return ErrAlreadyInRoom
+	}
+	if r.capacity > 0 && len(r.members) >= r.capacity {
+		r.Unlock()
+		return ErrRoomFull
+	}
+	c.Lock()
+	if !c.connected {
+		c.Unlock()
+		r.Unlock()
+		return ErrNotConnected
+	}
+	if c.rooms == nil {
+		c.rooms = make(map[string]*Room)
+	}
+	c.rooms[r.name] = r
+	c.Unlock()
+	r.members[c.id] = c
+	onJoin := r.onJoin
+	r.Unlock()
+	if onJoin != nil {
+		r.server.safely(c, func() {
+			onJoin(r, c)
+		})
+	}
+	return nil
+}
+
+// Removes a client from the room.
+// Returns an error if the client isn't in the room.
+func (r *Room) Leave(c *Client) error {
+	c.Lock()
+	if c.rooms[r.name] == r {
+		delete(c.rooms, r.name)
+	}
+	c.Unlock()
+	return r.remove(c)
+}
+
+func (r *Room) remove(c *Client) error {
+	r.Lock()
+	if _, exists := r.members[c.id]; !exists {
+		r.Unlock()
+		return ErrNotInRoom
+	}
+	delete(r.members, c.id)
+	onLeave := r.onLeave
+	r.Unlock()
+	if onLeave != nil {
+		r.server.safely(c, func() {
+			onLeave(r, c)
+		})
+	}
+	return nil
+}
+
+// Returns the clients in the room in their connection order.
+func (r *Room) Members() []*Client {
+	r.Lock()
+	ids := make([]float64, 0, len(r.members))
+	for id := range r.members {
+		ids = append(ids, id)
+	}
+	sort.Float64s(ids)
+	clients := make([]*Client, 0, len(ids))
+	for _, id := range ids {
+		clients = append(clients, r.members[id])
+	}
+	r.Unlock()
+	return clients
+}
+
+// Returns the number of clients in the room.
+func (r *Room) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.members)
+}
+
+// Reports whether the client is in the room.
+func (r *Room) Has(c *Client) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.members[c.id] == c
+}
+
+// Send text message to every client in the room, except the clients excluded.
+// Returns the number of clients data was sent to, and an error if the number is 0.
+func (r *Room) Send(message string, excluded ...*Client) (int, error) {
+	return r.server.broadcastCount(r.Members(), message, excluding(excluded))
+}
+
+// Returns the rooms the client is in, sorted by name.
+func (c *Client) Rooms() []*Room {
+	c.Lock()
+	rooms := make([]*Room, 0, len(c.rooms))
+	for _, r := range c.rooms {
+		rooms = append(rooms, r)
+	}
+	c.Unlock()
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].name < rooms[j].name
+	})
+	return rooms
+}
+
+func (c *Client) leaveRooms() {
+	c.Lock()
+	rooms := c.rooms
+	c.rooms = nil
+	c.Unlock()
+	for _, r := range rooms {
+		r.remove(c)
+	}
+}
@@ -2,11 +2,14 @@ package tcp_server
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
+	"log/slog"
 	"net"
 	"sort"
 	"sync"
+	"time"
 )
 
 // server instance.
@@ -14,19 +17,66 @@ import (
 type Server struct {
 	sync.Mutex
 	wg                       sync.WaitGroup
-	clients                  map[float64]*Client
+	clients                  []*Client
 	address                  string
 	listener                 net.Listener
 	config                   *tls.Config
 	started                  bool
 	maxid                    float64
+	done                     chan struct{}
+	pull                     bool
+	pullOff                  chan struct{}
+	acceptq                  chan *Client
+	rooms                    map[string]*Room
+	queueSize                int
+	queuePolicy              QueuePolicy
+	parallelism              int
+	eventLoop                bool
+	poller                   *poller
+	maxClients               int
+	maxClientsPerIP          int
+	maxClientsPerSubnet      int
+	subnetBits4              int
+	subnetBits6              int
+	connCount                int
+	ipCount                  map[string]int
+	subnetCount              map[string]int
+	rejectMessage            string
+	onConnectionRejected     func(addr net.Addr, reason RejectReason)
+	clientRateLimit          RateLimit
+	ipRateLimit              RateLimit
+	rateLimitPolicy          RateLimitPolicy
+	ipLimiters               map[string]*limiter
+	onRateLimited            func(c *Client, ev RateLimitEvent)
+	acl                      *AccessList
+	banPolicy                BanPolicy
+	failures                 map[string]*failureRecord
+	failuresSwept            time.Time
+	onBan                    func(ev BanEvent)
+	idleTimeout              time.Duration
+	idleWarning              time.Duration
+	idleMessage              string
+	writeTimeout             time.Duration
+	handshakeTimeout         time.Duration
+	heartbeat                Heartbeat
+	keepAlive                *net.KeepAliveConfig
+	logHandler               slog.Handler
+	logLevel                 slog.Leveler
+	panicPolicy              PanicPolicy
+	onPanic                  func(c *Client, recovered any, stack []byte)
+	metrics                  Metrics
+	tracer                   Tracer
+	transcript               func(c *Client) TranscriptSink
 	onNewClient              func(c *Client) bool
 	onClientConnectionClosed func(c *Client, err error)
 	onNewMessage             func(c *Client, message string)
+	middleware               []Middleware
+	handler                  Handler
 }
 
 // Called when a client connection is received, and before data is received by the client in the background.
 // To accept a connection, this function must return true.
+// If no callback is set, connections are rejected unless Accept is in use.
 func (s *Server) OnNewClient(callback func(c *Client) bool) {
 	s.Lock()
 	s.onNewClient = callback
@@ -34,16 +84,18 @@ func (s *Server) OnNewClient(callback func(c *Client) bool) {
 }
 
 // Called after Client is disconnected.
+// err is a *CloseError saying why it was disconnected.
 func (s *Server) OnClientConnectionClosed(callback func(c *Client, err error)) {
 	s.Lock()
 	s.onClientConnectionClosed = callback
 	s.Unlock()
 }
 
-// Called when Client receives new message
+// Called when Client receives new message, after any middleware added with Use.
 func (s *Server) OnNewMessage(callback func(c *Client, message string)) {
 	s.Lock()
 	s.onNewMessage = callback
+	s.buildHandler()
 	s.Unlock()
 }
 
@@ -52,7 +104,7 @@ func (s *Server) Start() error {
 	s.Lock()
 	defer s.Unlock()
 	if s.started {
-		return errors.New("already started")
+		return ErrAlreadyStarted
 	}
 	var err error
 	var listener net.Listener
@@ -64,6 +116,18 @@ func (s *Server) Start() error {
 	if err != nil {
 		return err
 	}
+	if s.eventLoop {
+		s.poller, err = newPoller()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.poller.run()
+		}()
+	}
 	s.started = true
 	s.listener = listener
 	s.wg.Add(1)
@@ -79,12 +143,14 @@ func (s *Server) Stop() {
 	if err != nil {
 		return
 	}
+	close(s.done)
 	for _, c := range s.clients {
-		if c != nil {
-			s.Unlock()
-			c.close()
-			s.Lock()
-		}
+		s.Unlock()
+		c.closeWithReason(CloseServerStopped, nil)
+		s.Lock()
+	}
+	if s.poller != nil {
+		s.poller.close()
 	}
 }
 
@@ -102,66 +168,192 @@ func (s *Server) accept() {
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.log(slog.LevelError, "accept failed", slog.Any("error", err))
+			}
 			return
 		}
-		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-		client := &Client{
-			conn:   conn,
-			ip:     ip,
-			r:      bufio.NewReader(conn),
-			pmsg:   make(chan string),
-			w:      bufio.NewWriter(conn),
-			server: s,
-		}
+		subnet, reason := s.admit(remoteIP(conn))
 		s.wg.Add(1)
-		go s.add(client)
+		if reason != 0 {
+			go s.reject(conn, reason)
+			continue
+		}
+		c := s.newClient(conn)
+		c.admitted = true
+		c.subnet = subnet
+		go s.add(c)
 	}
 }
 
-func (s *Server) clientsSorted() []*Client {
-	clients := []*Client{}
-	ids := []float64{}
-	s.Lock()
-	defer s.Unlock()
-	if len(s.clients) == 0 {
-		return clients
+func remoteIP(conn net.Conn) string {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return ip
+}
+
+func (s *Server) newClient(conn net.Conn) *Client {
+	ip := remoteIP(conn)
+	c := &Client{
+		conn:        conn,
+		ip:          ip,
+		pmsg:        make(chan string),
+		done:        make(chan struct{}),
+		server:      s,
+		connectedAt: time.Now(),
 	}
-	for id, c := range s.clients {
-		if c != nil {
-			ids = append(ids, id)
-		}
+	s.Lock()
+	c.initQueue(s.queueSize, s.queuePolicy)
+	c.idleTimeout = s.idleTimeout
+	c.idleWarning = s.idleWarning
+	c.idleMessage = s.idleMessage
+	c.writeTimeout = s.writeTimeout
+	c.hbConfig = s.heartbeat
+	c.metrics = s.metrics
+	c.tracer = s.tracer
+	keepAlive := s.keepAlive
+	eventLoop := s.poller != nil
+	s.Unlock()
+	ctx := context.Background()
+	if c.tracer != nil {
+		ctx, c.span = c.tracer.Start(ctx, SpanConnection, slog.String("network.peer.address", conn.RemoteAddr().String()), slog.String("server.address", s.listenerName()))
 	}
-	sort.Float64s(ids)
-	for _, id := range ids {
-		clients = append(clients, s.clients[id])
+	c.ctx, c.cancel = context.WithCancelCause(ctx)
+	setKeepAlive(conn, keepAlive)
+	if eventLoop && pollable(conn) {
+		// Buffers are only held while the event loop has a partial line to keep.
+		c.lb = &lineBuffer{}
+	} else {
+		c.r = bufio.NewReader(conn)
+		c.w = bufio.NewWriter(conn)
 	}
-	return clients
+	return c
+}
+
+// Returns the clients in their connection order.
+// The slice is shared, and must not be modified. Clients are only ever appended to it in place, and it is copied when a client is removed, so it stays valid while it is read.
+func (s *Server) clientsSorted() []*Client {
+	s.Lock()
+	defer s.Unlock()
+	return s.clients
 }
 
 // Returns the clients in there connection order.
 func (s *Server) Clients() []*Client {
-	return s.clientsSorted()
+	clients := s.clientsSorted()
+	return append(make([]*Client, 0, len(clients)), clients...)
 }
 
 func (s *Server) add(c *Client) {
 	s.Lock()
-	s.clients[s.maxid] = c
+	// IDs only ever increase, so appending keeps the clients in order.
+	s.clients = append(s.clients, c)
 	c.id = s.maxid
 	s.maxid++
 	c.connected = true
+	onNewClient := s.onNewClient
+	pull := s.pull
+	pullOff := s.pullOff
+	transcript := s.transcript
 	s.Unlock()
-	if !s.onNewClient(c) {
-		c.close()
+	if c.span != nil {
+		c.span.SetAttributes(slog.Int64("tcp_server.client.id", int64(c.id)))
+	}
+	if transcript != nil {
+		var sink TranscriptSink
+		if !s.safely(c, func() {
+			sink = transcript(c)
+		}) {
+			select {
+			case <-c.done:
+				// The panic policy disconnected the client.
+				return
+			default:
+			}
+		}
+		if sink != nil {
+			c.transcript.Store(&sink)
+			c.record(TranscriptOpen, c.conn.RemoteAddr().String())
+		}
+	}
+	c.log(slog.LevelDebug, "connection accepted")
+	if c.metrics != nil {
+		c.metrics.ConnectionAccepted()
+	}
+	c.startIdleTimer()
+	if err := c.handshake(); err != nil {
+		c.log(slog.LevelWarn, "TLS handshake failed", slog.Any("error", err))
+		select {
+		case <-s.done:
+		default:
+			s.ReportFailure(c.ip, FailureProtocol)
+		}
+		c.closeWithReason(CloseHandshakeFailed, err)
+		return
+	}
+	accepted := pull
+	if onNewClient != nil {
+		accepted = false
+		ok := s.safely(c, func() {
+			accepted = onNewClient(c)
+		})
+		if ok && !accepted {
+			s.ReportFailure(c.ip, FailureRejected)
+		}
+	}
+	if !accepted {
+		c.log(slog.LevelInfo, "client rejected")
+		c.closeWithReason(CloseRejected, nil)
 		return
 	}
-	go c.listen()
+	c.Lock()
+	c.authorized = true
+	c.Unlock()
+	c.log(slog.LevelInfo, "client connected")
+	if pull {
+		c.Messages()
+		select {
+		case s.acceptq <- c:
+		case <-pullOff:
+			// Accept mode was disabled, so the client is handled by the callbacks instead.
+			c.Lock()
+			c.msgs = nil
+			c.Unlock()
+		case <-c.done:
+			return
+		case <-s.done:
+			c.closeWithReason(CloseServerStopped, nil)
+			return
+		}
+	}
+	c.startHeartbeat()
+	if c.lb != nil {
+		if err := s.poller.add(c); err == nil {
+			// Lines OnNewClient read past are handled before waiting for more.
+			go c.servePending(c.startListening())
+			return
+		}
+		// Fall back to reading with a goroutine of our own.
+		c.wl.Lock()
+		c.w = bufio.NewWriter(c.conn)
+		c.wl.Unlock()
+		c.Lock()
+		c.r = bufio.NewReader(c.conn)
+		c.lb = nil
+		c.Unlock()
+	}
+	go c.listen(c.startListening())
 }
 
-func (s *Server) remove(cid float64) {
+func (s *Server) remove(c *Client) {
 	s.Lock()
-	_, exists := s.clients[cid]
-	if exists {
-		delete(s.clients, cid)
+	i := sort.Search(len(s.clients), func(i int) bool {
+		return s.clients[i].id >= c.id
+	})
+	if i < len(s.clients) && s.clients[i] == c {
+		clients := make([]*Client, 0, len(s.clients)-1)
+		clients = append(clients, s.clients[:i]...)
+		s.clients = append(clients, s.clients[i+1:]...)
+		s.release(c)
 	}
 	s.Unlock()
 	s.wg.Done()
@@ -171,57 +363,13 @@ func (s *Server) remove(cid float64) {
 // Set excluded to nill to send to all clients.
 // Returns the number of clients data was sent to, and an error if the number is 0.
 func (s *Server) SendAll(message string, excluded *Client) (int, error) {
-	count := 0
-	if message == "" {
-		return count, errors.New("empty string invalid")
-	}
-	clients := s.clientsSorted()
-	if len(clients) == 0 {
-		return count, errors.New("no clients available")
-	}
-	for _, sc := range clients {
-		if excluded != nil && sc == excluded {
-			continue
-		}
-		sent := sc.Send(message)
-		if sent {
-			count++
-		}
-	}
-	if count == 0 {
-		return count, errors.New("sent to no clients")
-	}
-	return count, nil
+	return s.broadcastCount(s.clientsSorted(), message, excluding([]*Client{excluded}))
 }
 
 func (s *Server) sendAuthorized(message string, excluded *Client, authorized bool) (int, error) {
-	count := 0
-	if message == "" {
-		return count, errors.New("empty string invalid")
-	}
-	clients := s.clientsSorted()
-	if len(clients) == 0 {
-		return count, errors.New("no clients available")
-	}
-	for _, sc := range clients {
-		sc.Lock()
-		if sc.authorized != authorized {
-			sc.Unlock()
-			continue
-		}
-		sc.Unlock()
-		if excluded != nil && sc == excluded {
-			continue
-		}
-		sent := sc.Send(message)
-		if sent {
-			count++
-		}
-	}
-	if count == 0 {
-		return count, errors.New("sent to no clients")
-	}
-	return count, nil
+	return s.broadcastCount(s.clientsSorted(), message, func(c *Client) bool {
+		return c != excluded && c.isAuthorized() == authorized
+	})
 }
 
 // Send text message to all authorized clients, except the excluded client.
@@ -241,13 +389,12 @@ func New(address string) *Server {
 	server := &Server{
 		address: address,
 		config:  nil,
-		clients: make(map[float64]*Client),
 		maxid:   1,
+		done:    make(chan struct{}),
+		acceptq: make(chan *Client),
+		acl:     NewAccessList(),
 	}
 
-	server.OnNewClient(func(c *Client) bool {
-		return false
-	})
 	server.OnNewMessage(func(c *Client, message string) {})
 	server.OnClientConnectionClosed(func(c *Client, err error) {})
 
@@ -2,11 +2,22 @@ package tcp_server
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"net/http/httptest"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -214,3 +225,2445 @@ func Test_multiple_clients(t *testing.T) {
 	}
 
 }
+
+func Test_middleware_order(t *testing.T) {
+	s := New(addr)
+	order := []string{}
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, c *Client, message string) {
+				order = append(order, name)
+				next.ServeMessage(ctx, c, message+name)
+			})
+		}
+	}
+	s.OnNewMessage(func(c *Client, message string) {
+		order = append(order, "callback:"+message)
+	})
+	s.Use(mark("a"), mark("b"))
+	s.Use(mark("c"))
+
+	s.messageHandler().ServeMessage(context.Background(), &Client{}, "")
+
+	expected := "a b c callback:abc"
+	if got := strings.Join(order, " "); got != expected {
+		t.Error("Middleware called in the wrong order.\r\nReceived \"" + got + "\"\r\nExpected \"" + expected + "\"")
+	}
+
+	order = order[:0]
+	s.Use(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c *Client, message string) {
+			order = append(order, "stop")
+		})
+	})
+	s.messageHandler().ServeMessage(context.Background(), &Client{}, "")
+	if got := strings.Join(order, " "); got != "a b c stop" {
+		t.Error("Middleware that doesn't call the next handler should stop processing. Received \"" + got + "\"")
+	}
+}
+
+// Connects a client to s over an in-memory pipe, returning the client and the remote end of the connection.
+func pipeClient(s *Server) (*Client, net.Conn) {
+	local, remote := net.Pipe()
+	c := s.newClient(local)
+	s.wg.Add(1)
+	s.add(c)
+	return c, remote
+}
+
+func Test_client_handler_stack(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	events := []string{}
+	var el sync.Mutex
+	event := func(e string) {
+		el.Lock()
+		events = append(events, e)
+		el.Unlock()
+	}
+	state := func(name string) *State {
+		return &State{
+			OnEnter: func(c *Client) {
+				event("enter " + name)
+			},
+			OnMessage: func(ctx context.Context, c *Client, message string) {
+				event(name + " " + message)
+			},
+			OnExit: func(c *Client) {
+				event("exit " + name)
+			},
+		}
+	}
+	s.OnNewMessage(func(c *Client, message string) {
+		event("server " + message)
+	})
+
+	c, remote := pipeClient(s)
+	h := s.messageHandler()
+	h.ServeMessage(c.Context(), c, "1")
+	c.SetHandler(state("login"))
+	h.ServeMessage(c.Context(), c, "2")
+	c.SetHandler(state("lobby"))
+	c.PushHandler(state("game"))
+	h.ServeMessage(c.Context(), c, "3")
+	c.PopHandler()
+	h.ServeMessage(c.Context(), c, "4")
+	c.PushHandler(state("editor"))
+	remote.Close()
+	c.Close()
+
+	expected := "server 1, enter login, login 2, exit login, enter lobby, enter game, game 3, exit game, lobby 4, enter editor, exit editor, exit lobby"
+	el.Lock()
+	defer el.Unlock()
+	if got := strings.Join(events, ", "); got != expected {
+		t.Error("Handler stack events are incorrect.\r\nReceived \"" + got + "\"\r\nExpected \"" + expected + "\"")
+	}
+	if c.Handler() != nil {
+		t.Error("Handlers should be cleared when a client disconnects.")
+	}
+}
+
+func Test_client_detach(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	received := make(chan string, 2)
+	release := make(chan struct{})
+	s.OnNewMessage(func(c *Client, message string) {
+		if message == "first" {
+			if err := c.Detach(); err != nil {
+				t.Error("Unable to detach from a message handler.", err)
+			}
+			<-release
+		}
+		received <- message
+	})
+	c, remote := pipeClient(s)
+	defer remote.Close()
+	if err := c.Detach(); err == nil {
+		t.Error("Detaching outside of a message handler should fail.")
+	}
+	fmt.Fprint(remote, "first\nsecond\n")
+	select {
+	case message := <-received:
+		if message != "second" {
+			t.Error("The second message should be handled while the first handler is detached. Received \"" + message + "\"")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The second message wasn't handled while the first handler was detached.")
+	}
+	close(release)
+	if message := <-received; message != "first" {
+		t.Error("Expected the detached handler to finish. Received \"" + message + "\"")
+	}
+}
+
+func Test_client_hijack(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	received := make(chan string, 3)
+	s.OnNewMessage(func(c *Client, message string) {
+		received <- message
+		if message != "hijack" {
+			return
+		}
+		_, r, err := c.Hijack()
+		if err != nil {
+			t.Error("Unable to hijack a client from a message handler.", err)
+			return
+		}
+		go func() {
+			line, _ := r.ReadString('\n')
+			received <- "raw " + line
+			c.Resume()
+		}()
+	})
+	c, remote := pipeClient(s)
+	defer remote.Close()
+	if _, _, err := c.Hijack(); err == nil {
+		t.Error("Hijacking outside of a message handler should fail.")
+	}
+	fmt.Fprint(remote, "hijack\nunprocessed\nresumed\n")
+	got := []string{}
+	for i := 0; i < 3; i++ {
+		select {
+		case message := <-received:
+			got = append(got, message)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for messages. Received", got)
+		}
+	}
+	expected := "hijack, raw unprocessed\n, resumed"
+	if strings.Join(got, ", ") != expected {
+		t.Error("Messages were handled incorrectly while hijacked.\r\nReceived \"" + strings.Join(got, ", ") + "\"\r\nExpected \"" + expected + "\"")
+	}
+}
+
+func Test_client_detach_prompt(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	received := make(chan string, 2)
+	s.OnNewMessage(func(c *Client, message string) {
+		if message == "ask" {
+			c.Detach()
+			answer, _ := c.ReadPrompt("Name?")
+			received <- "answer " + answer
+			return
+		}
+		received <- message
+	})
+	_, remote := pipeClient(s)
+	defer remote.Close()
+	lines := readLines(remote)
+	fmt.Fprint(remote, "ask\n")
+	<-lines
+	<-lines
+	fmt.Fprint(remote, "Bob\nnext\n")
+	got := []string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case message := <-received:
+			got = append(got, message)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for messages. Received", got)
+		}
+	}
+	if strings.Join(got, ", ") != "answer Bob, next" {
+		t.Error("The prompt of a detached handler wasn't answered by the new reader. Received \"" + strings.Join(got, ", ") + "\"")
+	}
+}
+
+func Test_accept_and_messages(t *testing.T) {
+	s := New("127.0.0.1:0")
+	if err := s.Start(); err != nil {
+		t.Fatal("Unable to start the server.", err)
+	}
+	defer func() {
+		s.Stop()
+		s.Wait()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := s.Accept(ctx); !errors.Is(err, ErrNotAccepting) {
+		t.Error("Accept should fail until accept mode is enabled.", err)
+	}
+	s.SetAcceptMode(true)
+	accepted := make(chan *Client)
+	go func() {
+		c, err := s.Accept(ctx)
+		if err != nil {
+			t.Error("Unable to accept a client.", err)
+		}
+		accepted <- c
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect to test server.", err)
+	}
+	c := <-accepted
+	if c == nil {
+		t.FailNow()
+	}
+	fmt.Fprint(conn, "one\ntwo\n")
+	for _, expected := range []string{"one", "two"} {
+		select {
+		case m := <-c.Messages():
+			if m.Text != expected || m.Client != c {
+				t.Error("Received the wrong message. Received \"" + m.Text + "\", expected \"" + expected + "\"")
+			}
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for a message.")
+		}
+	}
+	conn.Close()
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Error("The done channel wasn't closed after the client disconnected.")
+	}
+
+	cancel()
+	if _, err := s.Accept(ctx); err == nil {
+		t.Error("Accept should fail once the context is cancelled.")
+	}
+}
+
+func Test_accept_skips_disconnected(t *testing.T) {
+	s := New(addr)
+	s.SetLogLevel(slog.LevelError + 1)
+	s.SetAcceptMode(true)
+	waiting := func() *Client {
+		local, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		c := s.newClient(local)
+		s.wg.Add(1)
+		go s.add(c)
+		return c
+	}
+	gone := waiting()
+	time.Sleep(time.Millisecond * 10)
+	gone.Close()
+	stayed := waiting()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := s.Accept(ctx)
+	if err != nil || c != stayed {
+		t.Error("Accept should skip clients that disconnected while waiting.", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	stayed.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("A client that disconnected while waiting to be accepted was never removed.")
+	}
+}
+
+func Test_accept_mode_disabled(t *testing.T) {
+	s := New(addr)
+	s.SetLogLevel(slog.LevelError + 1)
+	received := make(chan string, 1)
+	s.OnNewMessage(func(c *Client, message string) {
+		received <- message
+	})
+	s.SetAcceptMode(true)
+	failed := make(chan error)
+	go func() {
+		_, err := s.Accept(context.Background())
+		failed <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	s.SetAcceptMode(false)
+	select {
+	case err := <-failed:
+		if !errors.Is(err, ErrNotAccepting) {
+			t.Error("Disabling accept mode should end a waiting Accept with ErrNotAccepting.", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disabling accept mode didn't end a waiting Accept.")
+	}
+
+	// A client held for Accept is handed to the message handlers once accept mode is disabled.
+	s.SetAcceptMode(true)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	s.wg.Add(1)
+	go s.add(s.newClient(local))
+	time.Sleep(time.Millisecond * 10)
+	s.SetAcceptMode(false)
+	fmt.Fprint(remote, "hello\r\n")
+	select {
+	case message := <-received:
+		if message != "hello" {
+			t.Error("Received \"" + message + "\", expected \"hello\"")
+		}
+	case <-time.After(time.Second):
+		t.Error("A client held for Accept wasn't handed to the message handlers.")
+	}
+}
+
+func Test_client_context(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	c, remote := pipeClient(s)
+	ctx := c.Context()
+	if ctx.Err() != nil {
+		t.Fatal("The client context shouldn't be cancelled while the client is connected.")
+	}
+	remote.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("The client context wasn't cancelled after the client disconnected.")
+	}
+	var ce *CloseError
+	if cause := context.Cause(ctx); !errors.As(cause, &ce) || ce.Reason != ClosePeerHungUp || !errors.Is(cause, io.EOF) {
+		t.Error("The cause of the cancellation should be the read error.", cause)
+	}
+	if c.CloseError() != ce {
+		t.Error("The close error wasn't stored on the client.", c.CloseError())
+	}
+}
+
+// Reads lines from the remote end of a pipe client in the background.
+func readLines(conn net.Conn) <-chan string {
+	lines := make(chan string, 16)
+	go func() {
+		defer close(lines)
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimRight(line, "\r\n")
+		}
+	}()
+	return lines
+}
+
+func Test_rooms(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	a, ra := pipeClient(s)
+	b, rb := pipeClient(s)
+	c, rc := pipeClient(s)
+	la, lb, lc := readLines(ra), readLines(rb), readLines(rc)
+	defer ra.Close()
+	defer rb.Close()
+	defer rc.Close()
+
+	events := make(chan string, 8)
+	r := s.Room("lobby")
+	r.OnJoin(func(r *Room, c *Client) {
+		events <- "join " + strconv.FormatInt(c.ID(), 10)
+	})
+	r.OnLeave(func(r *Room, c *Client) {
+		events <- "leave " + strconv.FormatInt(c.ID(), 10)
+	})
+	r.SetCapacity(2)
+	r.SetTopic("Welcome")
+	if s.Room("lobby") != r || r.Topic() != "Welcome" {
+		t.Error("Room should return the existing room.")
+	}
+	if err := r.Join(a); err != nil {
+		t.Error("Unable to join a room.", err)
+	}
+	if err := r.Join(a); err == nil {
+		t.Error("Joining a room twice should fail.")
+	}
+	if err := r.Join(b); err != nil {
+		t.Error("Unable to join a room.", err)
+	}
+	if err := r.Join(c); err == nil {
+		t.Error("Joining a full room should fail.")
+	}
+	if members := r.Members(); len(members) != 2 || members[0] != a || members[1] != b {
+		t.Error("Room members are incorrect.", members)
+	}
+	if rooms := a.Rooms(); len(rooms) != 1 || rooms[0] != r {
+		t.Error("Client rooms are incorrect.", rooms)
+	}
+
+	count, err := r.Send("hello", a)
+	if count != 1 || err != nil {
+		t.Error("Room message should be sent to 1 client.", count, err)
+	}
+	select {
+	case line := <-lb:
+		if line != "hello" {
+			t.Error("Received the wrong room message. \"" + line + "\"")
+		}
+	case <-time.After(time.Second):
+		t.Error("Room message wasn't received.")
+	}
+	select {
+	case line := <-la:
+		t.Error("Excluded client received a room message. \"" + line + "\"")
+	case line := <-lc:
+		t.Error("Client outside of the room received a room message. \"" + line + "\"")
+	default:
+	}
+
+	expectEvents := func(expected ...string) {
+		for _, e := range expected {
+			select {
+			case got := <-events:
+				if got != e {
+					t.Error("Room events are incorrect. Received \"" + got + "\", expected \"" + e + "\"")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Timed out waiting for room event \"" + e + "\"")
+			}
+		}
+	}
+	expectEvents("join "+strconv.FormatInt(a.ID(), 10), "join "+strconv.FormatInt(b.ID(), 10))
+
+	rb.Close()
+	expectEvents("leave " + strconv.FormatInt(b.ID(), 10))
+	if r.Has(b) || r.Len() != 1 || len(b.Rooms()) != 0 {
+		t.Error("Disconnected clients should be removed from their rooms.")
+	}
+	if !s.RemoveRoom("lobby") || len(s.Rooms()) != 0 || r.Len() != 0 {
+		t.Error("Removing a room should remove its members.")
+	}
+	expectEvents("leave " + strconv.FormatInt(a.ID(), 10))
+}
+
+func Test_send_where(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	b, rb := pipeClient(s)
+	c, rc := pipeClient(s)
+	lb := readLines(rb)
+	readLines(rc)
+	defer rb.Close()
+	defer rc.Close()
+
+	res, err := s.SendAllExcept("hello", c)
+	if err != nil {
+		t.Error("Failed to send message.", err)
+	}
+	if res.Sent() != 1 || res.Skipped() != 1 || res.Failed() != 0 {
+		t.Error("Broadcast result counts are incorrect.", res.Sent(), res.Skipped(), res.Failed())
+	}
+	if len(res.Results) != 2 || res.Results[0].Client != b || res.Results[0].Status != SendSent || res.Results[1].Client != c || res.Results[1].Status != SendSkipped {
+		t.Error("Broadcast results are incorrect.", res.Results)
+	}
+	if line := <-lb; line != "hello" {
+		t.Error("Received the wrong message. \"" + line + "\"")
+	}
+
+	res, err = s.SendWhere("nobody", func(c *Client) bool {
+		return false
+	})
+	if err == nil || res.Skipped() != 2 {
+		t.Error("A broadcast that reaches no clients should fail.", res.Results, err)
+	}
+
+	rb.Close()
+	<-b.Done()
+	res, _ = s.broadcast([]*Client{b, c}, "failing", nil)
+	if res.Results[0].Status != SendFailed || res.Results[0].Err == nil || res.Results[1].Status != SendSent {
+		t.Error("Sending to a disconnected client should be reported as a failure.", res.Results)
+	}
+}
+
+func Test_outbound_queue(t *testing.T) {
+	policies := []struct {
+		policy   QueuePolicy
+		expected string
+	}{
+		{QueueBlock, "1 2 3 4"},
+		{QueueDropOldest, "1 3 4"},
+		{QueueDropNewest, "1 2 3"},
+		{QueueDisconnect, ""},
+	}
+	for _, p := range policies {
+		s := New(addr)
+		s.OnNewClient(func(c *Client) bool {
+			return true
+		})
+		s.SetOutboundQueue(2, p.policy)
+		c, remote := pipeClient(s)
+
+		// The first message is taken by the writer, which blocks until the remote end reads it.
+		if c.Send("1") != nil {
+			t.Error(p.policy, "Unable to queue a message.")
+		}
+		for c.QueueLen() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		c.Send("2")
+		c.Send("3")
+		if c.QueueLen() != 2 {
+			t.Error(p.policy, "Queue length should be 2, got", c.QueueLen())
+		}
+		sent := make(chan bool)
+		go func() {
+			sent <- c.Send("4") == nil
+		}()
+		select {
+		case ok := <-sent:
+			if p.policy == QueueBlock {
+				t.Error(p.policy, "Send should block while the queue is full.")
+			}
+			if ok != (p.policy == QueueDropOldest) {
+				t.Error(p.policy, "Send returned the wrong result for a full queue.", ok)
+			}
+		case <-time.After(time.Millisecond * 50):
+			if p.policy != QueueBlock {
+				t.Fatal(p.policy, "Send shouldn't block when the queue is full.")
+			}
+		}
+		if p.policy == QueueDisconnect {
+			select {
+			case <-c.Done():
+			case <-time.After(time.Second):
+				t.Error(p.policy, "The client wasn't disconnected when its queue was full.")
+			}
+			remote.Close()
+			continue
+		}
+
+		lines := readLines(remote)
+		got := []string{}
+		for len(got) < len(strings.Fields(p.expected)) {
+			select {
+			case line := <-lines:
+				got = append(got, line)
+			case <-time.After(time.Second):
+				t.Fatal(p.policy, "Timed out waiting for queued messages. Received", got)
+			}
+		}
+		if p.policy == QueueBlock && !<-sent {
+			t.Error(p.policy, "Blocked message wasn't sent.")
+		}
+		if strings.Join(got, " ") != p.expected {
+			t.Error(p.policy, "Queued messages are incorrect. Received \""+strings.Join(got, " ")+"\", expected \""+p.expected+"\"")
+		}
+		remote.Close()
+	}
+}
+
+func Test_outbound_queue_close(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.SetLogLevel(slog.LevelError + 1)
+	s.SetOutboundQueue(16, QueueBlock)
+	c, remote := pipeClient(s)
+	lines := readLines(remote)
+	c.Send("one")
+	c.Send("bye")
+	c.Close()
+	got := []string{}
+	for line := range lines {
+		got = append(got, line)
+	}
+	if strings.Join(got, " ") != "one bye" {
+		t.Error("Messages queued before closing should be written. Received \"" + strings.Join(got, " ") + "\"")
+	}
+
+	// A client that never reads holds up closing only until the write timeout.
+	s.SetWriteTimeout(time.Millisecond * 50)
+	c, remote = pipeClient(s)
+	defer remote.Close()
+	c.Send("unread")
+	start := time.Now()
+	c.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Closing waited too long for the queue to be written:", elapsed)
+	}
+}
+
+// A connection that discards everything written to it, taking delay to do so.
+type discardConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (d discardConn) Write(b []byte) (int, error) {
+	if d.delay > 0 {
+		time.Sleep(d.delay)
+	}
+	return len(b), nil
+}
+
+func (d discardConn) Close() error {
+	return nil
+}
+
+func (d discardConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9999}
+}
+
+// Returns a server with n connected clients that discard their messages, every slowEvery of which is slow to write to.
+func benchServer(n, slowEvery int, slow time.Duration) *Server {
+	s := New(addr)
+	for i := 0; i < n; i++ {
+		conn := discardConn{}
+		if slowEvery > 0 && i%slowEvery == 0 {
+			conn.delay = slow
+		}
+		c := s.newClient(conn)
+		c.connected = true
+		c.id = s.maxid
+		s.maxid++
+		s.clients = append(s.clients, c)
+	}
+	return s
+}
+
+// The broadcast as it was before clients were kept in order and sent to concurrently, for comparison.
+func legacySendAll(clients map[float64]*Client, message string) int {
+	ids := []float64{}
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Float64s(ids)
+	sorted := []*Client{}
+	for _, id := range ids {
+		sorted = append(sorted, clients[id])
+	}
+	count := 0
+	for _, c := range sorted {
+		if c.Send(message) == nil {
+			count++
+		}
+	}
+	return count
+}
+
+func benchmarkBroadcast(b *testing.B, n, slowEvery int, slow time.Duration) {
+	message := "This is a message broadcast to every client."
+	s := benchServer(n, slowEvery, slow)
+	b.Run("legacy", func(b *testing.B) {
+		clients := make(map[float64]*Client)
+		for _, c := range s.clients {
+			clients[c.id] = c
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if legacySendAll(clients, message) != n {
+				b.Fatal("Message not sent to every client.")
+			}
+		}
+	})
+	for _, parallelism := range []int{1, 16} {
+		b.Run("parallelism-"+strconv.Itoa(parallelism), func(b *testing.B) {
+			s.SetBroadcastParallelism(parallelism)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if res, _ := s.SendAllExcept(message); res.Sent() != n {
+					b.Fatal("Message not sent to every client.")
+				}
+			}
+		})
+		b.Run("count-parallelism-"+strconv.Itoa(parallelism), func(b *testing.B) {
+			s.SetBroadcastParallelism(parallelism)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if sent, _ := s.SendAll(message, nil); sent != n {
+					b.Fatal("Message not sent to every client.")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	benchmarkBroadcast(b, 20000, 0, 0)
+}
+
+func BenchmarkBroadcastSlowClients(b *testing.B) {
+	benchmarkBroadcast(b, 1024, 64, time.Millisecond)
+}
+
+func Test_event_loop(t *testing.T) {
+	s := New("127.0.0.1:0")
+	if err := s.SetEventLoop(true); err != nil {
+		t.Skip("Event loop not supported.", err)
+	}
+	var login atomic.Bool
+	s.OnNewClient(func(c *Client) bool {
+		if login.Load() {
+			user, err := c.Readln()
+			c.Send("welcome " + user)
+			return err == nil
+		}
+		return true
+	})
+	s.OnNewMessage(func(c *Client, message string) {
+		if message == "prompt" {
+			answer, aborted := c.ReadPrompt("Name?")
+			if aborted {
+				return
+			}
+			message = "name " + answer
+		}
+		c.Send("echo " + message)
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal("Unable to start the server.", err)
+	}
+	defer func() {
+		s.Stop()
+		s.Wait()
+	}()
+	if err := s.SetEventLoop(false); err == nil {
+		t.Error("The event loop shouldn't be changed once the server is started.")
+	}
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect to test server.", err)
+	}
+	defer conn.Close()
+	lines := readLines(conn)
+	expect := func(expected string) {
+		select {
+		case line := <-lines:
+			if line != expected {
+				t.Error("Received \"" + line + "\", expected \"" + expected + "\"")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for \"" + expected + "\"")
+		}
+	}
+	fmt.Fprint(conn, "one\ntw")
+	expect("echo one")
+	time.Sleep(time.Millisecond * 10)
+	fmt.Fprint(conn, "o\nthree\n")
+	expect("echo two")
+	expect("echo three")
+	fmt.Fprint(conn, "prompt\n")
+	expect("Name?")
+	expect("Enter abort to cancel.")
+	fmt.Fprint(conn, "Alice\n")
+	expect("echo name Alice")
+
+	// Idle clients shouldn't hold a goroutine each.
+	before := runtime.NumGoroutine()
+	idle := []net.Conn{}
+	for i := 0; i < 50; i++ {
+		c, err := net.Dial("tcp", s.listener.Addr().String())
+		if err != nil {
+			t.Fatal("Failed to connect to test server.", err)
+		}
+		idle = append(idle, c)
+	}
+	for len(s.Clients()) != 51 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if grown := runtime.NumGoroutine() - before; grown >= 50 {
+		t.Error("Idle clients are holding goroutines. The number of goroutines grew by", grown)
+	}
+	for _, c := range idle {
+		c.Close()
+	}
+
+	// Lines sent along with those read by OnNewClient are handled without waiting for more.
+	login.Store(true)
+	conn, err = net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect to test server.", err)
+	}
+	defer conn.Close()
+	lines = readLines(conn)
+	fmt.Fprint(conn, "user\nhello\n")
+	expect("welcome user")
+	expect("echo hello")
+}
+
+// The line sanitizer as it was before it was made single pass, for comparison.
+func legacyStringFormatWithBS(str string) string {
+	if str == "" {
+		return ""
+	}
+	ts := ""
+	for _, chr := range str {
+		if chr == 8 {
+			if ts != "" && len(ts) > 1 {
+				ts = ts[:len(ts)-1]
+				continue
+			} else if len(ts) == 1 {
+				ts = ""
+				continue
+			}
+			continue
+		}
+		if chr < 32 || chr > 126 {
+			continue
+		}
+		ts += string(chr)
+	}
+	return ts
+}
+
+// Returns a client reading from r and writing to w, without a server running.
+func readerClient(r io.Reader, w net.Conn) *Client {
+	s := New(addr)
+	c := s.newClient(w)
+	c.r = bufio.NewReaderSize(r, 16)
+	c.connected = true
+	return c
+}
+
+func Test_line_sanitizing(t *testing.T) {
+	lines := []string{
+		"plain text\r\n",
+		"back\bspace\n",
+		"\b\b\bleading backspaces\n",
+		"too many\b\b\b\b\b\b\b\b\b\b\b\n",
+		"tabs\tand\x00control\x1bcharacters\n",
+		"non-ASCII café ☃ characters\n",
+		"a line much longer than the reader's buffer, which must be read in pieces\n",
+		"backspace across\b\b\b\b\b\b pieces of the buffer\n",
+		"\n",
+	}
+	c := readerClient(strings.NewReader(strings.Join(lines, "")), discardConn{})
+	for _, line := range lines {
+		expected := legacyStringFormatWithBS(line)
+		got, err := c.readln()
+		if err != nil {
+			t.Fatal("Unable to read a line.", err)
+		}
+		if got != expected {
+			t.Error("Line sanitized incorrectly.\r\nReceived \"" + got + "\"\r\nExpected \"" + expected + "\"")
+		}
+	}
+}
+
+// Reads the same line forever.
+type repeatReader struct {
+	line []byte
+}
+
+func (r repeatReader) Read(b []byte) (int, error) {
+	n := 0
+	for n+len(r.line) <= len(b) {
+		n += copy(b[n:], r.line)
+	}
+	return n, nil
+}
+
+func BenchmarkReadln(b *testing.B) {
+	line := []byte("This is a typical line of text sent by a client.\r\n")
+	c := readerClient(nil, discardConn{})
+	c.r = bufio.NewReader(repeatReader{line})
+	b.ReportAllocs()
+	b.SetBytes(int64(len(line)))
+	for i := 0; i < b.N; i++ {
+		if _, err := c.readln(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLegacyStringFormatWithBS(b *testing.B) {
+	line := "This is a typical line of text sent by a client.\r\n"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		legacyStringFormatWithBS(line)
+	}
+}
+
+func BenchmarkSanitizeLine(b *testing.B) {
+	line := []byte("This is a typical line of text sent by a client.\r\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sanitizeLine(line)
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	message := "This is a typical message sent to a client."
+	b.Run("buffered", func(b *testing.B) {
+		c := readerClient(nil, discardConn{})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if c.Send(message) != nil {
+				b.Fatal("Message not sent.")
+			}
+		}
+	})
+	b.Run("event-loop", func(b *testing.B) {
+		c := readerClient(nil, discardConn{})
+		c.w = nil
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if c.Send(message) != nil {
+				b.Fatal("Message not sent.")
+			}
+		}
+	})
+}
+
+func Test_connection_limits(t *testing.T) {
+	s := New("127.0.0.1:0")
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	rejected := make(chan RejectReason, 4)
+	s.OnConnectionRejected(func(addr net.Addr, reason RejectReason) {
+		rejected <- reason
+	})
+	s.SetRejectMessage("Too many connections.")
+	if err := s.Start(); err != nil {
+		t.Fatal("Unable to start the server.", err)
+	}
+	defer func() {
+		s.Stop()
+		s.Wait()
+	}()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", s.listener.Addr().String())
+		if err != nil {
+			t.Fatal("Failed to connect to test server.", err)
+		}
+		return conn
+	}
+	waitClients := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for len(s.Clients()) != n {
+			if time.Now().After(deadline) {
+				t.Fatal("Expected", n, "clients, but there are", len(s.Clients()))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	expectRejected := func(reason RejectReason) {
+		conn := dial()
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if line != "Too many connections.\r\n" {
+			t.Error("The rejection message wasn't received.", line, err)
+		}
+		select {
+		case got := <-rejected:
+			if got != reason {
+				t.Error("Connection rejected for the wrong reason. Received \"" + got.String() + "\", expected \"" + reason.String() + "\"")
+			}
+		case <-time.After(time.Second):
+			t.Error("The connection wasn't rejected for \"" + reason.String() + "\"")
+		}
+	}
+
+	limits := []struct {
+		set    func(n int)
+		reason RejectReason
+	}{
+		{s.SetMaxClients, RejectMaxClients},
+		{s.SetMaxClientsPerIP, RejectMaxClientsPerIP},
+		{func(n int) {
+			s.SetMaxClientsPerSubnet(n, 24, 64)
+		}, RejectMaxClientsPerSubnet},
+	}
+	for _, limit := range limits {
+		limit.set(2)
+		a, b := dial(), dial()
+		waitClients(2)
+		expectRejected(limit.reason)
+		a.Close()
+		waitClients(1)
+		c := dial()
+		waitClients(2)
+		b.Close()
+		c.Close()
+		waitClients(0)
+		limit.set(0)
+	}
+}
+
+func Test_subnet_key(t *testing.T) {
+	keys := map[string]string{
+		"192.168.1.20":         "192.168.1.0/24",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+		"::ffff:10.0.0.1":      "10.0.0.0/24",
+		"fe80::1:2:3:4%eth0":   "fe80::/64",
+		"pipe":                 "",
+	}
+	for ip, expected := range keys {
+		if got := subnetKey(ip, 24, 64); got != expected {
+			t.Error("Wrong subnet for " + ip + ". Received \"" + got + "\", expected \"" + expected + "\"")
+		}
+	}
+}
+
+func Test_rate_limit_escalation(t *testing.T) {
+	s := New(addr)
+	c := s.newClient(discardConn{})
+	c.connected = true
+	policy := RateLimitPolicy{MaxDelay: time.Second, DisconnectAfter: 2}
+	now := time.Now()
+	c.updateLimiters(RateLimit{Messages: 1, MessageBurst: 2}, RateLimit{Bytes: 100, ByteBurst: 100}, now)
+
+	steps := []struct {
+		after  time.Duration
+		size   int
+		action RateLimitAction
+		perIP  bool
+	}{
+		{0, 10, 0, false},
+		{0, 10, 0, false},
+		// The message burst is used up, so the next message waits for a token.
+		{0, 10, RateLimitDelayed, false},
+		// That message took the token before it arrived, so this one would wait too long.
+		{0, 10, RateLimitDropped, false},
+		{time.Second * 3, 10, 0, false},
+		// The byte burst shared by the IP address is used up.
+		{0, 100, RateLimitDelayed, true},
+		{0, 200, RateLimitDropped, true},
+		{0, 200, RateLimitDisconnected, true},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		ev := c.checkRateLimit(step.size, policy, now)
+		if ev.Action != step.action || (ev.Action != 0 && ev.PerIP != step.perIP) {
+			t.Error("Step", i, "received", ev, "expected", step.action, "per IP", step.perIP)
+		}
+	}
+	c.releaseRateLimit()
+	if len(s.ipLimiters) != 0 {
+		t.Error("The limiter for the IP address should be removed once no clients use it.")
+	}
+}
+
+func Test_rate_limit_default_burst(t *testing.T) {
+	s := New(addr)
+	c := s.newClient(discardConn{})
+	c.connected = true
+	now := time.Now()
+	c.updateLimiters(RateLimit{Bytes: 10000}, RateLimit{}, now)
+	steps := []struct {
+		after  time.Duration
+		size   int
+		action RateLimitAction
+	}{
+		// An unset burst allows a second's worth at once.
+		{0, 5, 0},
+		{0, 9995, 0},
+		{0, 5, RateLimitDropped},
+		// A full bucket lets through a message longer than the burst.
+		{time.Second, 20000, 0},
+		{time.Second, 5, RateLimitDropped},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		if ev := c.checkRateLimit(step.size, RateLimitPolicy{}, now); ev.Action != step.action {
+			t.Error("Step", i, "received", ev, "expected", step.action)
+		}
+	}
+}
+
+func Test_rate_limit_disconnect(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	handled := make(chan string, 4)
+	s.OnNewMessage(func(c *Client, message string) {
+		handled <- message
+	})
+	events := make(chan RateLimitEvent, 4)
+	s.OnRateLimited(func(c *Client, ev RateLimitEvent) {
+		events <- ev
+	})
+	s.SetClientRateLimit(RateLimit{Messages: 0.1})
+	s.SetRateLimitPolicy(RateLimitPolicy{Warning: "Slow down.", DisconnectAfter: 2})
+	c, remote := pipeClient(s)
+	lines := readLines(remote)
+	go fmt.Fprint(remote, "one\ntwo\nthree\n")
+
+	if message := <-handled; message != "one" {
+		t.Error("The first message should be handled. Received \"" + message + "\"")
+	}
+	for _, action := range []RateLimitAction{RateLimitDropped, RateLimitDisconnected} {
+		select {
+		case ev := <-events:
+			if ev.Action != action {
+				t.Error("Received rate limit event", ev.Action, "expected", action)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for rate limit event", action)
+		}
+		if line := <-lines; line != "Slow down." {
+			t.Error("The warning wasn't sent. Received \"" + line + "\"")
+		}
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Error("The client wasn't disconnected.")
+	}
+	if len(handled) != 0 {
+		t.Error("Dropped messages were handled.")
+	}
+}
+
+func Test_access_list(t *testing.T) {
+	a := NewAccessList()
+	check := func(ip string, expected RejectReason) {
+		t.Helper()
+		if got := a.Check(ip); got != expected {
+			t.Error("Wrong result checking " + ip + ". Received \"" + got.String() + "\", expected \"" + expected.String() + "\"")
+		}
+	}
+	check("192.0.2.1", 0)
+	if err := a.Deny("192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Deny("2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Deny("not an address"); err == nil {
+		t.Error("Invalid entries should be refused.")
+	}
+	check("192.0.2.1", RejectDenied)
+	check("::ffff:192.0.2.1", RejectDenied)
+	check("2001:db8::1", RejectDenied)
+	check("2001:db8::2", 0)
+	check("198.51.100.1", 0)
+	check("pipe", 0)
+
+	a.Allow("198.51.100.0/24")
+	a.Allow("192.0.2.0/24")
+	check("198.51.100.1", 0)
+	check("203.0.113.1", RejectDenied)
+	check("fe80::1%eth0", RejectDenied)
+	check("pipe", RejectDenied)
+	a.Allow("fe80::/10")
+	check("fe80::1%eth0", 0)
+	a.RemoveAllow("fe80::/10")
+	check("192.0.2.1", RejectDenied)
+	if !a.RemoveDeny("192.0.2.0/24") || a.RemoveDeny("192.0.2.0/24") {
+		t.Error("Removing a denied entry should only succeed once.")
+	}
+	check("192.0.2.1", 0)
+	a.RemoveAllow("198.51.100.0/24")
+	a.RemoveAllow("192.0.2.0/24")
+
+	a.Ban("203.0.113.5", 0)
+	a.Ban("203.0.113.6", time.Millisecond*20)
+	check("203.0.113.5", RejectBanned)
+	check("203.0.113.6", RejectBanned)
+	if bans := a.Bans(); len(bans) != 2 || bans[0].IP != "203.0.113.5" || !bans[0].Until.IsZero() {
+		t.Error("Bans are incorrect.", bans)
+	}
+	time.Sleep(time.Millisecond * 30)
+	check("203.0.113.6", 0)
+	if !a.Unban("203.0.113.5") || a.Unban("203.0.113.5") {
+		t.Error("Unbanning should only succeed once.")
+	}
+	if bans := a.Bans(); len(bans) != 0 {
+		t.Error("Bans should be empty.", bans)
+	}
+}
+
+func Test_access_list_file(t *testing.T) {
+	path := t.TempDir() + "/acl"
+	write := func(contents string) {
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# Blocked networks\ndeny 192.0.2.0/24\n\nallow 2001:db8::/32\n")
+	a := NewAccessList()
+	reloaded := make(chan error, 4)
+	a.OnReload(func(err error) {
+		reloaded <- err
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := a.WatchFile(ctx, path, time.Millisecond*5); err != nil {
+		t.Fatal("Unable to load the access list.", err)
+	}
+	if a.Check("192.0.2.1") != RejectDenied || a.Check("2001:db8::1") != 0 || a.Check("2001:db9::1") != RejectDenied {
+		t.Error("The access list wasn't loaded correctly.")
+	}
+
+	write("deny 198.51.100.0/24\n")
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal("Unable to reload the access list.", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The access list wasn't reloaded.")
+	}
+	if a.Check("192.0.2.1") != 0 || a.Check("198.51.100.1") != RejectDenied {
+		t.Error("The access list wasn't reloaded correctly.")
+	}
+
+	write("deny 198.51.100.0/24\nblock 203.0.113.0/24\n")
+	if err := <-reloaded; err == nil {
+		t.Error("Invalid files should fail to load.")
+	}
+	if a.Check("198.51.100.1") != RejectDenied {
+		t.Error("The lists should be kept when the file fails to load.")
+	}
+}
+
+func Test_access_list_rejects_connections(t *testing.T) {
+	s := New("127.0.0.1:0")
+	s.OnNewClient(func(c *Client) bool {
+		t.Error("Denied connections shouldn't reach OnNewClient.")
+		return true
+	})
+	rejected := make(chan RejectReason, 1)
+	s.OnConnectionRejected(func(addr net.Addr, reason RejectReason) {
+		rejected <- reason
+	})
+	s.AccessList().Deny("127.0.0.1")
+	if err := s.Start(); err != nil {
+		t.Fatal("Unable to start the server.", err)
+	}
+	defer func() {
+		s.Stop()
+		s.Wait()
+	}()
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect to test server.", err)
+	}
+	defer conn.Close()
+	select {
+	case reason := <-rejected:
+		if reason != RejectDenied {
+			t.Error("Connection rejected for the wrong reason.", reason)
+		}
+	case <-time.After(time.Second):
+		t.Error("The connection wasn't rejected.")
+	}
+}
+
+func Test_automatic_bans(t *testing.T) {
+	s := New(addr)
+	s.SetBanPolicy(BanPolicy{MaxFailures: 3, Window: time.Second, Duration: time.Minute, MaxDuration: time.Minute * 3})
+	events := []BanEvent{}
+	s.OnBan(func(ev BanEvent) {
+		events = append(events, ev)
+	})
+	ip := "192.0.2.1"
+	for ban := 1; ban <= 3; ban++ {
+		for i := 1; i <= 3; i++ {
+			if banned := s.ReportFailure(ip, FailureAuth); banned != (i == 3) {
+				t.Error("Ban", ban, "failure", i, "banned", banned)
+			}
+		}
+		if s.AccessList().Check(ip) != RejectBanned {
+			t.Error("The address wasn't banned.")
+		}
+		if !s.Unban(ip) {
+			t.Error("Unable to lift the ban.")
+		}
+	}
+	if s.ReportFailure("192.0.2.2", FailureProtocol) {
+		t.Error("Other addresses shouldn't be affected.")
+	}
+	if len(events) != 3 {
+		t.Fatal("Expected 3 ban events, received", len(events))
+	}
+	for i, expected := range []time.Duration{time.Minute, time.Minute * 2, time.Minute * 3} {
+		ev := events[i]
+		d := time.Until(ev.Until)
+		if ev.IP != ip || ev.Kind != FailureAuth || ev.Failures != 3 || ev.Bans != i+1 || d > expected || d < expected-time.Second {
+			t.Error("Ban event", i, "is incorrect.", ev)
+		}
+	}
+}
+
+func Test_ban_failures_pruned(t *testing.T) {
+	s := New(addr)
+	s.SetBanPolicy(BanPolicy{MaxFailures: 3, Window: time.Millisecond * 10, ResetAfter: time.Millisecond * 10})
+	for i := 0; i < 100; i++ {
+		s.ReportFailure("10.0.0."+strconv.Itoa(i), FailureAuth)
+	}
+	time.Sleep(time.Millisecond * 20)
+	// Only the reporting address is pruned until the next sweep is due.
+	s.ReportFailure("10.0.0.1", FailureAuth)
+	s.ReportFailure("10.0.0.1", FailureAuth)
+	if n := len(s.failures); n != 100 {
+		t.Error("Expected the other addresses to wait for the sweep, but", n, "are remembered.")
+	}
+	if len(s.failures["10.0.0.1"].failures) != 2 {
+		t.Error("Expired failures of the reporting address should be forgotten.")
+	}
+	s.failuresSwept = time.Time{}
+	s.ReportFailure("10.0.0.200", FailureAuth)
+	if n := len(s.failures); n != 2 {
+		t.Error("Expected the sweep to forget the expired addresses, but", n, "are remembered.")
+	}
+}
+
+func Test_ban_default_window(t *testing.T) {
+	s := New(addr)
+	s.SetBanPolicy(BanPolicy{MaxFailures: 3})
+	for i := 0; i < 2; i++ {
+		if s.ReportFailure("10.0.0.1", FailureAuth) {
+			t.Fatal("The address was banned too early.")
+		}
+	}
+	if !s.ReportFailure("10.0.0.1", FailureAuth) {
+		t.Error("Expected the third failure within the default window to ban the address.")
+	}
+}
+
+func Test_rejected_clients_are_banned(t *testing.T) {
+	s := New("127.0.0.1:0")
+	s.OnNewClient(func(c *Client) bool {
+		return false
+	})
+	s.SetBanPolicy(BanPolicy{MaxFailures: 2, Window: time.Minute, Duration: time.Minute})
+	rejected := make(chan RejectReason, 1)
+	s.OnConnectionRejected(func(addr net.Addr, reason RejectReason) {
+		rejected <- reason
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal("Unable to start the server.", err)
+	}
+	defer func() {
+		s.Stop()
+		s.Wait()
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.listener.Addr().String())
+		if err != nil {
+			t.Fatal("Failed to connect to test server.", err)
+		}
+		// Wait for the server to reject us.
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect to test server.", err)
+	}
+	defer conn.Close()
+	select {
+	case reason := <-rejected:
+		if reason != RejectBanned {
+			t.Error("Connection rejected for the wrong reason.", reason)
+		}
+	case <-time.After(time.Second):
+		t.Error("The address wasn't banned after its clients were rejected.")
+	}
+	if bans := s.Bans(); len(bans) != 1 || bans[0].IP != "127.0.0.1" {
+		t.Error("Bans are incorrect.", bans)
+	}
+}
+
+func Test_idle_timeout(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.SetIdleTimeout(time.Millisecond * 300)
+	s.SetIdleWarning(time.Millisecond*150, "Are you still there?")
+	closed := make(chan error, 1)
+	s.OnClientConnectionClosed(func(c *Client, err error) {
+		closed <- err
+	})
+	start := time.Now()
+	_, conn := pipeClient(s)
+	defer conn.Close()
+	lines := readLines(conn)
+	// Activity puts off the warning and the disconnection.
+	time.Sleep(time.Millisecond * 100)
+	fmt.Fprint(conn, "still here\r\n")
+	select {
+	case line := <-lines:
+		if line != "Are you still there?" {
+			t.Error("Unexpected message.", line)
+		}
+		if elapsed := time.Since(start); elapsed < time.Millisecond*250 {
+			t.Error("The warning was sent too soon.", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The idle warning wasn't sent.")
+	}
+	select {
+	case err := <-closed:
+		if err == nil || err.Error() != "idle timeout" {
+			t.Error("Incorrect close reason.", err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Millisecond*400 {
+			t.Error("The client was disconnected too soon.", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Error("The idle client wasn't disconnected.")
+	}
+}
+
+func Test_idle_timeout_during_handler(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.OnNewMessage(func(c *Client, message string) {
+		if message == "work" {
+			time.Sleep(time.Millisecond * 500)
+			c.Send("done")
+		}
+	})
+	s.SetIdleTimeout(time.Millisecond * 200)
+	closed := make(chan error, 1)
+	s.OnClientConnectionClosed(func(c *Client, err error) {
+		closed <- err
+	})
+	_, conn := pipeClient(s)
+	defer conn.Close()
+	lines := readLines(conn)
+	stop := make(chan struct{})
+	defer close(stop)
+	// The client keeps sending while the handler runs, though nothing is read until it returns.
+	go func() {
+		fmt.Fprint(conn, "work\r\n")
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond * 50):
+				fmt.Fprint(conn, "still here\r\n")
+			}
+		}
+	}()
+	select {
+	case line := <-lines:
+		if line != "done" {
+			t.Error("Unexpected message.", line)
+		}
+	case err := <-closed:
+		t.Fatal("The client was disconnected while the handler was running.", err)
+	case <-time.After(time.Second):
+		t.Fatal("The handler didn't finish.")
+	}
+	select {
+	case err := <-closed:
+		t.Error("The active client was disconnected.", err)
+	case <-time.After(time.Millisecond * 300):
+	}
+}
+
+func Test_write_timeout(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.SetWriteTimeout(time.Millisecond * 50)
+	closed := make(chan error, 1)
+	s.OnClientConnectionClosed(func(c *Client, err error) {
+		closed <- err
+	})
+	c, conn := pipeClient(s)
+	defer conn.Close()
+	// Nothing reads from the other end of the pipe.
+	if c.Send("Hello") == nil {
+		t.Error("Sending to a stalled client succeeded.")
+	}
+	select {
+	case err := <-closed:
+		var ne net.Error
+		if err.(*CloseError).Reason != CloseWriteError || !errors.As(err, &ne) || !ne.Timeout() {
+			t.Error("Incorrect close reason.", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("The stalled client wasn't disconnected.")
+	}
+}
+
+func Test_handshake_timeout(t *testing.T) {
+	s := New(addr)
+	called := false
+	s.OnNewClient(func(c *Client) bool {
+		called = true
+		return true
+	})
+	s.SetHandshakeTimeout(time.Millisecond * 50)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c := s.newClient(tls.Server(local, &tls.Config{}))
+	s.wg.Add(1)
+	// The client never starts the handshake.
+	s.add(c)
+	if called {
+		t.Error("OnNewClient was called before the handshake completed.")
+	}
+	select {
+	case <-c.Done():
+		var ne net.Error
+		if err := c.CloseError(); err.Reason != CloseHandshakeFailed || !errors.As(err, &ne) || !ne.Timeout() {
+			t.Error("Incorrect close reason.", err)
+		}
+	default:
+		t.Error("The client wasn't disconnected.")
+	}
+}
+
+func Test_heartbeat(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.SetHeartbeat(Heartbeat{Interval: time.Millisecond * 50, Timeout: time.Millisecond * 100, Ping: "PING", Pong: "PONG"})
+	received := make(chan string, 10)
+	s.OnNewMessage(func(c *Client, message string) {
+		received <- message
+	})
+	closed := make(chan error, 1)
+	s.OnClientConnectionClosed(func(c *Client, err error) {
+		closed <- err
+	})
+	c, conn := pipeClient(s)
+	defer conn.Close()
+	lines := readLines(conn)
+	for i := 0; i < 3; i++ {
+		select {
+		case line := <-lines:
+			if line != "PING" {
+				t.Fatal("Unexpected message.", line)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No ping was sent.")
+		}
+		time.Sleep(time.Millisecond * 10)
+		fmt.Fprint(conn, "PONG\r\n")
+	}
+	fmt.Fprint(conn, "Hello\r\n")
+	select {
+	case message := <-received:
+		if message != "Hello" {
+			t.Error("Pongs were passed to the message handler.", message)
+		}
+	case <-time.After(time.Second):
+		t.Error("The message wasn't received.")
+	}
+	if rtt := c.RTT(); rtt < time.Millisecond*10 || rtt > time.Millisecond*100 {
+		t.Error("Incorrect round trip time.", rtt)
+	}
+	// Stop replying.
+	select {
+	case err := <-closed:
+		if err == nil || err.Error() != "heartbeat timeout" {
+			t.Error("Incorrect close reason.", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("The unresponsive client wasn't disconnected.")
+	}
+}
+
+func Test_heartbeat_during_handler(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.SetHeartbeat(Heartbeat{Interval: time.Millisecond * 50, Timeout: time.Millisecond * 50, Ping: "PING", Pong: "PONG"})
+	s.OnNewMessage(func(c *Client, message string) {
+		if message == "work" {
+			time.Sleep(time.Millisecond * 400)
+			c.Send("done")
+		}
+	})
+	closed := make(chan error, 1)
+	s.OnClientConnectionClosed(func(c *Client, err error) {
+		closed <- err
+	})
+	_, conn := pipeClient(s)
+	defer conn.Close()
+	lines := readLines(conn)
+	// The pongs can't be read until the handler returns, so writing them blocks until then.
+	go fmt.Fprint(conn, "work\r\n")
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case line := <-lines:
+			switch line {
+			case "PING":
+				go fmt.Fprint(conn, "PONG\r\n")
+			case "done":
+				done = true
+			default:
+				t.Fatal("Unexpected message.", line)
+			}
+		case err := <-closed:
+			t.Fatal("The client was disconnected while the handler was running.", err)
+		case <-timeout:
+			t.Fatal("The handler didn't finish.")
+		}
+	}
+	deadline := time.After(time.Millisecond * 200)
+	for {
+		select {
+		case line := <-lines:
+			if line == "PING" {
+				go fmt.Fprint(conn, "PONG\r\n")
+			}
+		case err := <-closed:
+			t.Fatal("The client answering pings was disconnected.", err)
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func Test_heartbeat_telnet_nop(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.SetHeartbeat(Heartbeat{Interval: time.Millisecond * 20, Ping: TelnetNOP})
+	c, conn := pipeClient(s)
+	defer c.Close()
+	b := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := io.ReadAtLeast(conn, b, 4)
+	if err != nil {
+		t.Fatal("Unable to read pings.", err)
+	}
+	if string(b[:n]) != TelnetNOP+TelnetNOP {
+		t.Error("Incorrect pings received.", b[:n])
+	}
+	if c.RTT() != 0 {
+		t.Error("A round trip time was measured without pongs.")
+	}
+}
+
+func Test_close_with_reason(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.SetOutboundQueue(16, QueueBlock)
+	closed := make(chan error, 1)
+	s.OnClientConnectionClosed(func(c *Client, err error) {
+		closed <- err
+	})
+	c, conn := pipeClient(s)
+	defer conn.Close()
+	lines := readLines(conn)
+	for i := 0; i < 5; i++ {
+		c.Send("Message " + strconv.Itoa(i))
+	}
+	if err := c.CloseWithReason(CloseBanned, "Goodbye"); err != nil {
+		t.Error("Unable to close the client.", err)
+	}
+	received := []string{}
+	for line := range lines {
+		received = append(received, line)
+	}
+	if len(received) != 6 || received[5] != "Goodbye" {
+		t.Error("Queued messages and the farewell weren't written before closing.", received)
+	}
+	err := <-closed
+	if ce, ok := err.(*CloseError); !ok || ce.Reason != CloseBanned || ce.Err != nil || c.CloseError() != ce {
+		t.Error("Incorrect close reason.", err)
+	}
+	if err.Error() != "address banned" {
+		t.Error("Incorrect close error message.", err)
+	}
+}
+
+func Test_errors(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	if _, err := s.SendAllExcept("hello"); !errors.Is(err, ErrNoClients) {
+		t.Error("Expected ErrNoClients.", err)
+	}
+	a, _ := pipeClient(s)
+	b, remote := pipeClient(s)
+	defer remote.Close()
+	if err := a.Send("\r\n"); !errors.Is(err, ErrEmptyMessage) {
+		t.Error("Expected ErrEmptyMessage.", err)
+	}
+	if err := a.Detach(); !errors.Is(err, ErrNotInHandler) {
+		t.Error("Expected ErrNotInHandler.", err)
+	}
+	clients := s.clientsSorted()
+	a.Close()
+	if err := a.Close(); !errors.Is(err, ErrAlreadyDisconnected) {
+		t.Error("Expected ErrAlreadyDisconnected.", err)
+	}
+	if err := a.Send("hello"); !errors.Is(err, ErrNotConnected) {
+		t.Error("Expected ErrNotConnected.", err)
+	}
+	_, err := s.broadcast(clients, "hello", func(c *Client) bool {
+		return c != b
+	})
+	var be *BroadcastError
+	if !errors.As(err, &be) || len(be.Failures) != 1 || be.Failures[0].Client != a {
+		t.Fatal("Expected a BroadcastError with a single failure.", err)
+	}
+	if !errors.Is(err, ErrNoneSent) || !errors.Is(err, ErrNotConnected) {
+		t.Error("The broadcast error should wrap ErrNoneSent and the failure.", err)
+	}
+	// Broadcasts returning only a count report their failures the same way.
+	sent, err := s.broadcastCount(clients, "hello", func(c *Client) bool {
+		return c != b
+	})
+	if sent != 0 || !errors.As(err, &be) || len(be.Failures) != 1 || be.Failures[0].Client != a {
+		t.Error("Expected a BroadcastError with a single failure from a count only broadcast.", sent, err)
+	}
+	if err := s.AccessList().Deny("not an address"); !errors.Is(err, ErrInvalidAddress) {
+		t.Error("Expected ErrInvalidAddress.", err)
+	}
+}
+
+// Collects log records for tests.
+type recordHandler struct {
+	sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *recordHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.Lock()
+	h.records = append(h.records, r)
+	h.Unlock()
+	return nil
+}
+
+func (h *recordHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *recordHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// Returns the messages logged, each followed by its attributes other than the stack.
+func (h *recordHandler) lines() []string {
+	h.Lock()
+	defer h.Unlock()
+	lines := []string{}
+	for _, r := range h.records {
+		line := r.Level.String() + " " + r.Message
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key != "stack" {
+				line += " " + a.String()
+			}
+			return true
+		})
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func Test_logging(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.OnNewMessage(func(c *Client, message string) {
+		panic(message)
+	})
+	h := &recordHandler{}
+	s.SetLogger(h)
+	c, conn := pipeClient(s)
+	defer conn.Close()
+	fmt.Fprint(conn, "oops\r\n")
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("The client wasn't disconnected after the handler panicked.")
+	}
+	id := strconv.FormatInt(c.ID(), 10)
+	expected := []string{
+		"DEBUG connection accepted listener=" + addr + " client=" + id + " ip=",
+		"INFO client connected listener=" + addr + " client=" + id + " ip=",
+		"ERROR callback panicked listener=" + addr + " client=" + id + " ip= panic=oops policy=close",
+		"WARN client disconnected listener=" + addr + " client=" + id + " ip= reason=handler panicked error=oops",
+	}
+	if lines := h.lines(); strings.Join(lines, "\r\n") != strings.Join(expected, "\r\n") {
+		t.Error("Incorrect log records.\r\n" + strings.Join(lines, "\r\n"))
+	}
+
+	h = &recordHandler{}
+	s.SetLogger(h)
+	s.SetLogLevel(slog.LevelWarn)
+	c, _ = pipeClient(s)
+	c.Close()
+	if lines := h.lines(); len(lines) != 0 {
+		t.Error("Records below the log level were logged.\r\n" + strings.Join(lines, "\r\n"))
+	}
+}
+
+func Test_panic_policy(t *testing.T) {
+	s := New(addr)
+	s.SetLogLevel(slog.LevelError + 1)
+	s.OnNewClient(func(c *Client) bool {
+		if c.ID() == 1 {
+			panic("rejected")
+		}
+		return true
+	})
+	received := make(chan string, 10)
+	s.OnNewMessage(func(c *Client, message string) {
+		if message == "boom" {
+			panic(message)
+		}
+		received <- message
+	})
+	type panicEvent struct {
+		c     *Client
+		value any
+		stack string
+	}
+	panics := make(chan panicEvent, 10)
+	s.OnPanic(func(c *Client, recovered any, stack []byte) {
+		panics <- panicEvent{c, recovered, string(stack)}
+	})
+	s.SetPanicPolicy(PanicContinue)
+
+	// A panic in OnNewClient still rejects the client.
+	rejected, conn := pipeClient(s)
+	conn.Close()
+	ev := <-panics
+	if ev.c != rejected || ev.value != "rejected" || !strings.Contains(ev.stack, "Test_panic_policy") {
+		t.Error("Incorrect panic event for OnNewClient.", ev.c, ev.value)
+	}
+	select {
+	case <-rejected.Done():
+	default:
+		t.Error("The client should be rejected when OnNewClient panics.")
+	}
+
+	c, conn := pipeClient(s)
+	defer conn.Close()
+	fmt.Fprint(conn, "boom\r\nhello\r\n")
+	select {
+	case message := <-received:
+		if message != "hello" {
+			t.Error("Unexpected message.", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The client wasn't kept alive after the handler panicked.")
+	}
+	if ev := <-panics; ev.c != c || ev.value != "boom" {
+		t.Error("Incorrect panic event for the message handler.", ev.c, ev.value)
+	}
+
+	// The panic is only handled once on its way up to crashing the program.
+	s.SetPanicPolicy(PanicCrash)
+	func() {
+		defer func() {
+			p, ok := recover().(*repanic)
+			if !ok || p.value != "crash" {
+				t.Error("The panic wasn't passed on.", p)
+			}
+		}()
+		s.safely(c, func() {
+			s.safely(c, func() {
+				panic("crash")
+			})
+		})
+	}()
+	if len(panics) != 1 {
+		t.Error("OnPanic should be called once, not", len(panics))
+	}
+
+	s.SetPanicPolicy(PanicClose)
+	<-panics
+	fmt.Fprint(conn, "boom\r\n")
+	select {
+	case <-c.Done():
+		if c.CloseError().Reason != ClosePanic {
+			t.Error("Incorrect close reason.", c.CloseError())
+		}
+	case <-time.After(time.Second):
+		t.Error("The client wasn't closed after the handler panicked.")
+	}
+}
+
+func Test_metrics(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return c.ID() != 1
+	})
+	handled := make(chan bool)
+	s.OnNewMessage(func(c *Client, message string) {
+		c.SendAll(message, nil)
+		handled <- true
+	})
+	m := NewPrometheusMetrics()
+	s.SetMetrics(m)
+	vars := NewExpvarMetrics(new(expvar.Map).Init())
+	s.SetMetrics(multiMetrics{m, vars})
+	rejected, _ := pipeClient(s)
+	<-rejected.Done()
+	c, conn := pipeClient(s)
+	defer conn.Close()
+	lines := readLines(conn)
+	fmt.Fprint(conn, "hello\r\n")
+	<-handled
+	if line := <-lines; line != "hello" {
+		t.Fatal("Unexpected message.", line)
+	}
+	answer := make(chan string)
+	go func() {
+		name, _ := c.ReadPrompt("Name?")
+		answer <- name
+	}()
+	if line := <-lines + <-lines; line != "Name?Enter abort to cancel." {
+		t.Fatal("Unexpected prompt.", line)
+	}
+	fmt.Fprint(conn, "Bob\r\n")
+	if name := <-answer; name != "Bob" {
+		t.Error("Incorrect answer.", name)
+	}
+	s.wg.Add(1)
+	s.reject(discardConn{}, RejectBanned)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Error("Incorrect content type.", ct)
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"# TYPE tcp_server_connections_accepted_total counter\ntcp_server_connections_accepted_total 2\n",
+		"tcp_server_connections_rejected_total{reason=\"address banned\"} 1\n",
+		"tcp_server_connections_closed_total{reason=\"rejected\"} 1\n",
+		"# TYPE tcp_server_connections_active gauge\ntcp_server_connections_active 1\n",
+		"tcp_server_messages_received_total 2\n",
+		"tcp_server_received_bytes_total 12\n",
+		"tcp_server_messages_sent_total 2\n",
+		"tcp_server_sent_bytes_total 38\n",
+		"tcp_server_broadcasts_total 1\n",
+		"tcp_server_broadcast_recipients_total 1\n",
+		"tcp_server_prompts_total 1\n",
+		"tcp_server_handler_duration_seconds_bucket{le=\"+Inf\"} 1\n",
+		"tcp_server_handler_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Error("Missing metric.\r\n" + expected + "\r\nin\r\n" + body)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		"connections_accepted": "2",
+		"connections_active":   "1",
+		"messages_received":    "2",
+		"sent_bytes":           "38",
+		"prompts":              "1",
+		"connections_rejected": "{\"address banned\": 1}",
+	} {
+		if v := vars.m.Get(name); v == nil || v.String() != expected {
+			t.Error("Incorrect expvar value for", name, v)
+		}
+	}
+}
+
+// Passes metrics to several implementations.
+type multiMetrics []Metrics
+
+func (mm multiMetrics) ConnectionAccepted() {
+	for _, m := range mm {
+		m.ConnectionAccepted()
+	}
+}
+
+func (mm multiMetrics) ConnectionRejected(reason RejectReason) {
+	for _, m := range mm {
+		m.ConnectionRejected(reason)
+	}
+}
+
+func (mm multiMetrics) ConnectionClosed(reason CloseReason) {
+	for _, m := range mm {
+		m.ConnectionClosed(reason)
+	}
+}
+
+func (mm multiMetrics) MessageReceived(bytes int) {
+	for _, m := range mm {
+		m.MessageReceived(bytes)
+	}
+}
+
+func (mm multiMetrics) MessageSent(bytes int) {
+	for _, m := range mm {
+		m.MessageSent(bytes)
+	}
+}
+
+func (mm multiMetrics) Broadcast(recipients int) {
+	for _, m := range mm {
+		m.Broadcast(recipients)
+	}
+}
+
+func (mm multiMetrics) HandlerDuration(d time.Duration) {
+	for _, m := range mm {
+		m.HandlerDuration(d)
+	}
+}
+
+func (mm multiMetrics) Prompt() {
+	for _, m := range mm {
+		m.Prompt()
+	}
+}
+
+func Test_client_stats(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	handling := make(chan bool)
+	release := make(chan bool)
+	s.OnNewMessage(func(c *Client, message string) {
+		c.Send("You said " + message)
+		handling <- true
+		<-release
+	})
+	before := time.Now()
+	c, conn := pipeClient(s)
+	defer conn.Close()
+	lines := readLines(conn)
+	st := c.Stats()
+	if st.ID != c.ID() || st.Listener != addr || st.RemoteAddr.String() != "pipe" || st.TLS != nil || st.ConnectedAt.Before(before) {
+		t.Error("Incorrect connection details.", st)
+	}
+	if !st.LastReceived.IsZero() || !st.LastSent.IsZero() || !st.LastActivity().Equal(st.ConnectedAt) {
+		t.Error("There should be no activity yet.", st)
+	}
+	fmt.Fprint(conn, "hello\r\n")
+	<-handling
+	<-lines
+	st = c.Stats()
+	if !st.InCallback || st.InPrompt {
+		t.Error("The client should be in a callback.", st)
+	}
+	if st.MessagesReceived != 1 || st.BytesReceived != 7 || st.MessagesSent != 1 || st.BytesSent != 16 {
+		t.Error("Incorrect message counts.", st)
+	}
+	if st.LastReceived.Before(st.ConnectedAt) || st.LastSent.Before(st.LastReceived) || !st.LastActivity().Equal(st.LastSent) {
+		t.Error("Incorrect activity times.", st)
+	}
+	release <- true
+	for c.Stats().InCallback {
+		time.Sleep(time.Millisecond)
+	}
+	go c.ReadPrompt("")
+	<-lines
+	if st = c.Stats(); !st.InPrompt {
+		t.Error("The client should be in a prompt.", st)
+	}
+}
+
+func Test_tracing(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.SetLogLevel(slog.LevelError + 1)
+	rec := NewTraceRecorder()
+	s.SetTracer(rec)
+	s.Use(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c *Client, message string) {
+			// The handler's context holds the message's span.
+			_, span := rec.Start(ctx, "child")
+			span.End()
+			_, span = rec.Start(context.Background(), "unrelated")
+			span.End()
+			next.ServeMessage(ctx, c, message)
+		})
+	})
+	s.OnNewMessage(func(c *Client, message string) {
+		if message == "name" {
+			c.ReadPrompt("Name?")
+		}
+		if message == "boom" {
+			panic(message)
+		}
+	})
+	c, conn := pipeClient(s)
+	lines := readLines(conn)
+	fmt.Fprint(conn, "name\r\n")
+	<-lines
+	<-lines
+	fmt.Fprint(conn, "Bob\r\nboom\r\n")
+	<-c.Done()
+
+	got := []string{}
+	for _, span := range rec.Spans() {
+		line := strconv.Itoa(span.ID) + " " + strconv.Itoa(span.ParentID) + " " + span.Name
+		if span.End.IsZero() {
+			line += " unfinished"
+		}
+		if len(span.Errors) > 0 {
+			line += " error=" + span.Errors[0].Error()
+		}
+		for _, key := range []string{"tcp_server.client.id", "tcp_server.message.bytes", "tcp_server.prompt.aborted", "tcp_server.close.reason"} {
+			if v, ok := span.Attr(key); ok {
+				line += " " + key + "=" + v.String()
+			}
+		}
+		got = append(got, line)
+	}
+	id := strconv.FormatInt(c.ID(), 10)
+	expected := []string{
+		"1 0 tcp_server.connection error=handler panicked: boom tcp_server.client.id=" + id + " tcp_server.close.reason=handler panicked",
+		"2 1 tcp_server.message tcp_server.message.bytes=4",
+		"3 2 child",
+		"4 0 unrelated",
+		"5 2 tcp_server.prompt tcp_server.prompt.aborted=false",
+		"6 1 tcp_server.message error=handler panicked tcp_server.message.bytes=4",
+		"7 6 child",
+		"8 0 unrelated",
+	}
+	if strings.Join(got, "\r\n") != strings.Join(expected, "\r\n") {
+		t.Error("Incorrect spans.\r\n" + strings.Join(got, "\r\n"))
+	}
+}
+
+func Test_read_prompt_menu(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	results := make(chan string, 1)
+	s.OnNewMessage(func(c *Client, message string) {
+		selected, aborted := c.ReadPromptMenu("Size?", []string{"small", "", "large"})
+		results <- fmt.Sprint(selected, aborted)
+	})
+	_, remote := pipeClient(s)
+	defer remote.Close()
+	lines := readLines(remote)
+	menu := func(head string) {
+		expected := []string{"Size?", "[1]: small", "[3]: large", "Enter abort to cancel."}
+		if head != "" {
+			expected = append([]string{head}, expected...)
+		}
+		got := []string{}
+		for range expected {
+			got = append(got, <-lines)
+		}
+		if strings.Join(got, "\r\n") != strings.Join(expected, "\r\n") {
+			t.Error("Unexpected menu.\r\nReceived:\r\n" + strings.Join(got, "\r\n") + "\r\nExpected:\r\n" + strings.Join(expected, "\r\n"))
+		}
+	}
+	for _, answers := range [][]string{{"3"}, {"4", "1"}, {"abort"}} {
+		fmt.Fprint(remote, "menu\r\n")
+		menu("")
+		for i, answer := range answers {
+			fmt.Fprint(remote, answer+"\r\n")
+			if i < len(answers)-1 {
+				menu("Invalid selection.")
+			}
+		}
+		if answers[0] == "abort" {
+			if line := <-lines; line != "Aborted." {
+				t.Error("Expected the menu to be aborted, received \"" + line + "\"")
+			}
+		}
+		expected := map[string]string{"3": "2 false", "4": "0 false", "abort": "-1 true"}[answers[0]]
+		if result := <-results; result != expected {
+			t.Error("Answering " + strings.Join(answers, ", ") + " returned \"" + result + "\", expected \"" + expected + "\"")
+		}
+	}
+}
+
+// Creates a server that takes orders through prompts, offering the given sizes.
+func orderServer(sizes []string) *Server {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		c.Send("Welcome.")
+		return true
+	})
+	s.SetLogLevel(slog.LevelError + 1)
+	s.OnNewMessage(func(c *Client, message string) {
+		if message != "order" {
+			c.Send("Unknown command.")
+			return
+		}
+		name, aborted := c.ReadPrompt("Name?")
+		if aborted {
+			return
+		}
+		delivery, aborted := c.ReadPromptConfirm("Delivery?")
+		if aborted {
+			return
+		}
+		size, aborted := c.ReadPromptMenu("Size?", sizes)
+		if aborted {
+			return
+		}
+		c.Send(fmt.Sprintf("%s: %s, delivery %v", name, sizes[size], delivery))
+	})
+	return s
+}
+
+func Test_transcript(t *testing.T) {
+	s := orderServer([]string{"small", "large"})
+	var buf strings.Builder
+	sink := NewJSONTranscript(&buf)
+	s.SetTranscript(func(c *Client) TranscriptSink {
+		return sink
+	})
+	closed := make(chan struct{})
+	s.OnClientConnectionClosed(func(c *Client, err error) {
+		close(closed)
+	})
+	local, conn := net.Pipe()
+	lines := readLines(conn)
+	s.wg.Add(1)
+	go s.add(s.newClient(local))
+	<-lines
+	for _, step := range []struct {
+		input string
+		lines int
+	}{
+		{"hello", 1},
+		{"order", 2},
+		{"Bob", 2},
+		{"maybe", 3},
+		{"yes", 4},
+		{"3", 5},
+		{"2", 1},
+		{"order", 2},
+		{"Ann", 2},
+		{"no", 4},
+		{"abort", 1},
+	} {
+		fmt.Fprint(conn, step.input+"\r\n")
+		for i := 0; i < step.lines; i++ {
+			<-lines
+		}
+	}
+	conn.Close()
+	<-closed
+
+	entries, err := ReadTranscript(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, e := range entries {
+		got = append(got, e.Dir+" "+e.Text)
+	}
+	if len(got) < 2 || got[0] != "open pipe" || got[1] != "out Welcome." || got[len(got)-1] != "close peer hung up" {
+		t.Error("Unexpected transcript:\r\n" + strings.Join(got, "\r\n"))
+	}
+	if i := strings.Index(strings.Join(got, "|"), "in 2|out Bob: large, delivery true"); i < 0 {
+		t.Error("Transcript doesn't hold the order:\r\n" + strings.Join(got, "\r\n"))
+	}
+	if got[len(got)-2] != "out Aborted." {
+		t.Error("Aborting the menu should end the transcript, got:\r\n" + strings.Join(got, "\r\n"))
+	}
+
+	diff, err := Replay(orderServer([]string{"small", "large"}), entries, time.Second)
+	if err != nil || len(diff) != 0 {
+		t.Error("Replaying against the same server should match, got:", err, "\r\n"+strings.Join(diff, "\r\n"))
+	}
+	diff, err = Replay(orderServer([]string{"small", "medium", "large"}), entries, 100*time.Millisecond)
+	if err != nil || strings.Join(diff, "|") != strings.Join([]string{
+		// "3" is now a valid size, so the order is taken without the second menu and "2" is taken as a command.
+		"-12: [2]: large", "-13: Enter abort to cancel.", "-14: Invalid selection.", "-15: Size?", "-16: [1]: small", "-17: [2]: large",
+		"+12: [2]: medium", "+13: [3]: large", "+16: Unknown command.",
+		"-26: [2]: large", "+23: [2]: medium", "+24: [3]: large",
+	}, "|") {
+		t.Error("Replaying against a changed server should differ, got:", err, "\r\n"+strings.Join(diff, "\r\n"))
+	}
+	if _, err := Replay(s, append(entries, TranscriptEntry{Client: entries[0].Client + 1}), time.Second); err == nil {
+		t.Error("Replaying several clients should fail")
+	}
+}
+
+func Test_transcript_files(t *testing.T) {
+	dir := t.TempDir()
+	s := orderServer(nil)
+	s.SetTranscript(TranscriptFiles(dir))
+	closed := make(chan struct{})
+	s.OnClientConnectionClosed(func(c *Client, err error) {
+		close(closed)
+	})
+	local, conn := net.Pipe()
+	lines := readLines(conn)
+	c := s.newClient(local)
+	s.wg.Add(1)
+	go s.add(c)
+	<-lines
+	fmt.Fprint(conn, "hello\r\n")
+	<-lines
+	conn.Close()
+	<-closed
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 || !strings.HasPrefix(files[0].Name(), strconv.FormatInt(c.ID(), 10)+"-") {
+		t.Fatal("Expected one transcript named after the client, got", files)
+	}
+	f, err := os.Open(dir + "/" + files[0].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := ReadTranscript(f)
+	got := []string{}
+	for _, e := range entries {
+		if e.Client != c.ID() {
+			t.Error("Entry for the wrong client:", e)
+		}
+		got = append(got, e.Dir+" "+e.Text)
+	}
+	expected := []string{"open pipe", "out Welcome.", "in hello", "out Unknown command.", "close peer hung up"}
+	if err != nil || strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Error("Unexpected transcript:", err, "\r\n"+strings.Join(got, "\r\n"))
+	}
+}
+
+func Test_transcript_open_panics(t *testing.T) {
+	s := New(addr)
+	s.SetLogLevel(slog.LevelError + 1)
+	var connected atomic.Int32
+	s.OnNewClient(func(c *Client) bool {
+		connected.Add(1)
+		return true
+	})
+	s.SetTranscript(func(c *Client) TranscriptSink {
+		panic("no transcript")
+	})
+	c, conn := pipeClient(s)
+	conn.Close()
+	<-c.Done()
+	if err := c.CloseError(); err == nil || err.Reason != ClosePanic {
+		t.Error("Expected the client to be disconnected by the panic, got", err)
+	}
+	if connected.Load() != 0 {
+		t.Error("OnNewClient shouldn't be called for a client that was disconnected.")
+	}
+
+	s.SetPanicPolicy(PanicContinue)
+	c, conn = pipeClient(s)
+	defer conn.Close()
+	if connected.Load() != 1 || c.transcript.Load() != nil {
+		t.Error("Expected the client to connect without a transcript.")
+	}
+}
+
+func Test_transcript_opened_while_sending(t *testing.T) {
+	s := New(addr)
+	s.OnNewClient(func(c *Client) bool {
+		return true
+	})
+	s.SetLogLevel(slog.LevelError + 1)
+	sink := &MemoryTranscript{}
+	s.SetTranscript(func(c *Client) TranscriptSink {
+		time.Sleep(time.Millisecond * 10)
+		return sink
+	})
+	stop := make(chan struct{})
+	sending := make(chan struct{})
+	go func() {
+		defer close(sending)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.SendAll("tick", nil)
+			}
+		}
+	}()
+	local, remote := net.Pipe()
+	lines := readLines(remote)
+	c := s.newClient(local)
+	s.wg.Add(1)
+	s.add(c)
+	<-lines
+	close(stop)
+	<-sending
+	remote.Close()
+	<-c.Done()
+	entries := sink.Entries()
+	if len(entries) == 0 || entries[0].Dir != TranscriptOpen {
+		t.Error("Expected the transcript to start when it was opened, got", entries)
+	}
+}
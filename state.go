@@ -0,0 +1,113 @@
+package tcp_server
+
+import "context"
+
+// Implemented by handlers that need to know when they become a client's active handler.
+type Enterer interface {
+	Enter(c *Client)
+}
+
+// Implemented by handlers that need to know when they stop being a client's active handler.
+type Exiter interface {
+	Exit(c *Client)
+}
+
+// State is a Handler with optional enter and exit hooks, for use with SetHandler, PushHandler and PopHandler.
+// Any of the functions may be nil.
+type State struct {
+	OnEnter   func(c *Client)
+	OnMessage func(ctx context.Context, c *Client, message string)
+	OnExit    func(c *Client)
+}
+
+// Calls OnMessage, if it is set.
+func (st *State) ServeMessage(ctx context.Context, c *Client, message string) {
+	if st.OnMessage != nil {
+		st.OnMessage(ctx, c, message)
+	}
+}
+
+// Calls OnEnter, if it is set.
+func (st *State) Enter(c *Client) {
+	if st.OnEnter != nil {
+		st.OnEnter(c)
+	}
+}
+
+// Calls OnExit, if it is set.
+func (st *State) Exit(c *Client) {
+	if st.OnExit != nil {
+		st.OnExit(c)
+	}
+}
+
+func handlerEnter(c *Client, h Handler) {
+	if e, ok := h.(Enterer); ok {
+		defer c.server.recoverPanic(c)
+		e.Enter(c)
+	}
+}
+
+func handlerExit(c *Client, h Handler) {
+	if e, ok := h.(Exiter); ok {
+		defer c.server.recoverPanic(c)
+		e.Exit(c)
+	}
+}
+
+// Replaces every handler set for the client with h, calling the exit hooks of the old handlers from the top of the stack down, then the enter hook of h.
+// Set h to nil to return the client to the server's OnNewMessage callback.
+func (c *Client) SetHandler(h Handler) {
+	c.Lock()
+	old := c.handlers
+	c.handlers = nil
+	if h != nil {
+		c.handlers = []Handler{h}
+	}
+	c.Unlock()
+	for i := len(old) - 1; i >= 0; i-- {
+		handlerExit(c, old[i])
+	}
+	if h != nil {
+		handlerEnter(c, h)
+	}
+}
+
+// Makes h the client's active handler, keeping the current one so it can be returned to with PopHandler.
+// The enter hook of h is called, but the exit hook of the handler underneath it isn't.
+func (c *Client) PushHandler(h Handler) {
+	if h == nil {
+		return
+	}
+	c.Lock()
+	c.handlers = append(c.handlers, h)
+	c.Unlock()
+	handlerEnter(c, h)
+}
+
+// Removes the client's active handler, calls its exit hook and returns it.
+// The handler underneath it becomes active again, or the server's OnNewMessage callback if there are none left.
+// Returns nil if no handlers were set.
+func (c *Client) PopHandler() Handler {
+	c.Lock()
+	if len(c.handlers) == 0 {
+		c.Unlock()
+		return nil
+	}
+	h := c.handlers[len(c.handlers)-1]
+	c.handlers[len(c.handlers)-1] = nil
+	c.handlers = c.handlers[:len(c.handlers)-1]
+	c.Unlock()
+	handlerExit(c, h)
+	return h
+}
+
+// Returns the client's active handler, or nil if the server's OnNewMessage callback is in use.
+func (c *Client) Handler() Handler {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.handlers) == 0 {
+		return nil
+	}
+	return c.handlers[len(c.handlers)-1]
+}
@@ -0,0 +1,97 @@
+package tcp_server
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// ClientStats is a snapshot of a client's connection and what it is doing, returned by Client.Stats.
+type ClientStats struct {
+	ID int64
+	// The address the server is listening on.
+	Listener   string
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// The state of the client's TLS connection, or nil if it isn't using TLS or hasn't completed the handshake.
+	TLS         *tls.ConnectionState
+	ConnectedAt time.Time
+	// When the last line was received from the client, or the zero time if none have been.
+	LastReceived time.Time
+	// When the last line was written to the client, or the zero time if none have been.
+	LastSent         time.Time
+	MessagesReceived int64
+	MessagesSent     int64
+	// Bytes of the lines received and written, including their line endings.
+	BytesReceived int64
+	BytesSent     int64
+	// The number of messages waiting in the client's outbound queue.
+	QueueLen int
+	// Whether the client is being shown a prompt.
+	InPrompt bool
+	// Whether a message handler is running for the client.
+	InCallback bool
+	Hijacked   bool
+	// The round trip time measured by the last heartbeat the client replied to.
+	RTT time.Duration
+}
+
+// Returns when the last line was received from or written to the client, or when it connected if there have been none.
+func (st ClientStats) LastActivity() time.Time {
+	last := st.ConnectedAt
+	if st.LastReceived.After(last) {
+		last = st.LastReceived
+	}
+	if st.LastSent.After(last) {
+		last = st.LastSent
+	}
+	return last
+}
+
+// Returns a snapshot of the client's connection and what it is doing.
+func (c *Client) Stats() ClientStats {
+	st := ClientStats{
+		Listener:         c.server.listenerName(),
+		RemoteAddr:       c.conn.RemoteAddr(),
+		LocalAddr:        c.conn.LocalAddr(),
+		ConnectedAt:      c.connectedAt,
+		LastReceived:     unixTime(c.lastRead.Load()),
+		LastSent:         unixTime(c.lastSent.Load()),
+		MessagesReceived: c.messagesIn.Load(),
+		MessagesSent:     c.messagesOut.Load(),
+		BytesReceived:    c.bytesIn.Load(),
+		BytesSent:        c.bytesOut.Load(),
+		QueueLen:         c.QueueLen(),
+	}
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		if state := tc.ConnectionState(); state.HandshakeComplete {
+			st.TLS = &state
+		}
+	}
+	c.Lock()
+	st.ID = int64(c.id)
+	st.InPrompt = c.prompt
+	st.InCallback = c.callbackRunning
+	st.Hijacked = c.hijacked
+	st.RTT = c.rtt
+	c.Unlock()
+	return st
+}
+
+// Returns the time for a number of nanoseconds since the Unix epoch, with 0 being the zero time.
+func unixTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Returns the address the server is listening on, or the address it will listen on if it hasn't started.
+func (s *Server) listenerName() string {
+	s.Lock()
+	defer s.Unlock()
+	if s.listener != nil {
+		return s.listener.Addr().String()
+	}
+	return s.address
+}
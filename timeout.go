@@ -0,0 +1,141 @@
+package tcp_server
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Disconnects clients connecting from now on once nothing has been received from them for the given time.
+// The time doesn't run out while what they send is waiting to be read, such as while a message handler is running.
+// Set timeout to 0 to never disconnect idle clients, which is the default.
+func (s *Server) SetIdleTimeout(timeout time.Duration) {
+	s.Lock()
+	s.idleTimeout = timeout
+	s.Unlock()
+}
+
+// Sends message to an idle client the given time before it is disconnected by the idle timeout.
+// Set before to 0 or message to an empty string to send no warning.
+func (s *Server) SetIdleWarning(before time.Duration, message string) {
+	s.Lock()
+	s.idleWarning = before
+	s.idleMessage = message
+	s.Unlock()
+}
+
+// Disconnects clients connecting from now on if writing a single message to them takes longer than the given time.
+// Set timeout to 0 to wait for writes indefinitely, which is the default.
+func (s *Server) SetWriteTimeout(timeout time.Duration) {
+	s.Lock()
+	s.writeTimeout = timeout
+	s.Unlock()
+}
+
+// Disconnects TLS clients that don't complete their handshake within the given time.
+// When it is set, the handshake is completed before OnNewClient is called.
+// Set timeout to 0 to leave the handshake until the connection is first read from or written to, which is the default.
+func (s *Server) SetHandshakeTimeout(timeout time.Duration) {
+	s.Lock()
+	s.handshakeTimeout = timeout
+	s.Unlock()
+}
+
+// Completes the TLS handshake for the client if the server has a handshake timeout.
+func (c *Client) handshake() error {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	s := c.server
+	s.Lock()
+	timeout := s.handshakeTimeout
+	s.Unlock()
+	if timeout <= 0 {
+		return nil
+	}
+	if err := tc.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	return tc.SetDeadline(time.Time{})
+}
+
+// Starts the client's idle timer, if the server has an idle timeout.
+// The client counts as idle from when it connected. Receiving a line only records the time, and the timer works out when it next needs to fire from that, so an active client costs nothing more.
+func (c *Client) startIdleTimer() {
+	if c.idleTimeout <= 0 {
+		return
+	}
+	c.Lock()
+	if c.connected {
+		c.idle = time.AfterFunc(c.idleWait(0), c.checkIdle)
+	}
+	c.Unlock()
+}
+
+// Records that something was received from the client.
+func (c *Client) touch() {
+	c.lastRead.Store(time.Now().UnixNano())
+	if c.idleTimeout > 0 {
+		c.idleWarned.Store(false)
+	}
+}
+
+// Returns how long the idle timer should wait for, when the client has been idle for the given time.
+func (c *Client) idleWait(idle time.Duration) time.Duration {
+	if c.idleWarning > 0 && c.idleMessage != "" && !c.idleWarned.Load() && idle < c.idleTimeout-c.idleWarning {
+		return c.idleTimeout - c.idleWarning - idle
+	}
+	return c.idleTimeout - idle
+}
+
+// Called by the idle timer to warn or disconnect the client if it has been idle for long enough.
+func (c *Client) checkIdle() {
+	c.Lock()
+	if !c.connected {
+		c.Unlock()
+		return
+	}
+	if c.hijacked || c.readingPaused() {
+		// Whatever is reading the connection is responsible for it, or what the client sends is waiting to be read.
+		c.idle.Reset(c.idleTimeout)
+		c.Unlock()
+		return
+	}
+	c.Unlock()
+	last := c.connectedAt
+	if lastRead := c.lastRead.Load(); lastRead != 0 {
+		last = time.Unix(0, lastRead)
+	}
+	idle := time.Since(last)
+	if idle >= c.idleTimeout {
+		c.closeWithReason(CloseIdleTimeout, nil)
+		return
+	}
+	if c.idleWarning > 0 && c.idleMessage != "" && idle >= c.idleTimeout-c.idleWarning && c.idleWarned.CompareAndSwap(false, true) {
+		c.Send(c.idleMessage)
+	}
+	c.Lock()
+	if c.connected {
+		c.idle.Reset(c.idleWait(idle))
+	}
+	c.Unlock()
+}
+
+// Stops the idle timer. Must be called with the client locked.
+func (c *Client) stopIdleTimer() {
+	if c.idle != nil {
+		c.idle.Stop()
+	}
+}
+
+// Sets the write deadline for the next message, if the client has a write timeout.
+// Must be called with c.wl locked.
+func (c *Client) setWriteDeadline() error {
+	if c.writeTimeout <= 0 {
+		return nil
+	}
+	return c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+}
@@ -0,0 +1,153 @@
+package tcp_server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Tracer starts the spans the server traces connections, messages and prompts with.
+// Its methods mirror OpenTelemetry's, so an adapter for an OpenTelemetry tracer only needs to convert the attributes.
+type Tracer interface {
+	// Starts a span as a child of any span in ctx, returning a context holding the new span.
+	Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span)
+}
+
+// Span is a single operation traced by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...slog.Attr)
+	RecordError(err error)
+	End()
+}
+
+// Names of the spans the server starts.
+const (
+	// Lasts from when a client connects until it disconnects, and is held by the client's context.
+	SpanConnection = "tcp_server.connection"
+	// Lasts while a message handler runs, as a child of the connection's span, and is held by the context the handler is given.
+	SpanMessage = "tcp_server.message"
+	// Lasts while a prompt waits for an answer, as a child of the span of the message whose handler showed it, or of the connection's span if it wasn't shown by a handler.
+	SpanPrompt = "tcp_server.prompt"
+)
+
+// Traces the connections of clients connecting from now on, the messages they send, and the prompts they are shown, with t.
+// Set t to nil to stop tracing, which is the default.
+func (s *Server) SetTracer(t Tracer) {
+	s.Lock()
+	s.tracer = t
+	s.Unlock()
+}
+
+// Starts a span for the client as a child of its connection's span, if the client is traced.
+func (c *Client) startSpan(name string, attrs ...slog.Attr) (context.Context, Span) {
+	if c.tracer == nil {
+		return c.ctx, nil
+	}
+	return c.tracer.Start(c.ctx, name, attrs...)
+}
+
+// Ends the client's connection span, recording why it disconnected.
+func (c *Client) endConnectionSpan(err *CloseError) {
+	if c.span == nil {
+		return
+	}
+	c.span.SetAttributes(slog.String("tcp_server.close.reason", err.Reason.String()))
+	if !err.Reason.normal() {
+		c.span.RecordError(err)
+	}
+	c.span.End()
+}
+
+// TraceRecorder is a Tracer that keeps the spans it starts in memory, for tests.
+type TraceRecorder struct {
+	l     sync.Mutex
+	spans []*RecordedSpan
+}
+
+// RecordedSpan is a span kept by a TraceRecorder.
+type RecordedSpan struct {
+	recorder *TraceRecorder
+	// Numbered from 1 in the order the spans were started.
+	ID int
+	// The ID of the span's parent, or 0 if it has none.
+	ParentID int
+	Name     string
+	Attrs    []slog.Attr
+	Errors   []error
+	Start    time.Time
+	// The zero time until the span has ended.
+	End time.Time
+}
+
+type recordedSpanKey struct{}
+
+// Creates a TraceRecorder to give to SetTracer.
+func NewTraceRecorder() *TraceRecorder {
+	return &TraceRecorder{}
+}
+
+func (r *TraceRecorder) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	span := &RecordedSpan{
+		recorder: r,
+		ID:       len(r.spans) + 1,
+		Name:     name,
+		Attrs:    append([]slog.Attr(nil), attrs...),
+		Start:    time.Now(),
+	}
+	if parent, ok := ctx.Value(recordedSpanKey{}).(*RecordedSpan); ok {
+		span.ParentID = parent.ID
+	}
+	r.spans = append(r.spans, span)
+	return context.WithValue(ctx, recordedSpanKey{}, span), recordedSpan{span}
+}
+
+// Returns copies of the spans started so far, in the order they were started.
+func (r *TraceRecorder) Spans() []RecordedSpan {
+	r.l.Lock()
+	defer r.l.Unlock()
+	spans := make([]RecordedSpan, len(r.spans))
+	for i, span := range r.spans {
+		spans[i] = *span
+		spans[i].Attrs = append([]slog.Attr(nil), span.Attrs...)
+		spans[i].Errors = append([]error(nil), span.Errors...)
+	}
+	return spans
+}
+
+// Returns the value of the span's attribute with the given key, and whether it has one.
+func (span RecordedSpan) Attr(key string) (slog.Value, bool) {
+	for i := len(span.Attrs) - 1; i >= 0; i-- {
+		if span.Attrs[i].Key == key {
+			return span.Attrs[i].Value, true
+		}
+	}
+	return slog.Value{}, false
+}
+
+// Implements Span for a RecordedSpan, updating it under the recorder's lock.
+type recordedSpan struct {
+	span *RecordedSpan
+}
+
+func (s recordedSpan) SetAttributes(attrs ...slog.Attr) {
+	s.span.recorder.l.Lock()
+	s.span.Attrs = append(s.span.Attrs, attrs...)
+	s.span.recorder.l.Unlock()
+}
+
+func (s recordedSpan) RecordError(err error) {
+	s.span.recorder.l.Lock()
+	s.span.Errors = append(s.span.Errors, err)
+	s.span.recorder.l.Unlock()
+}
+
+func (s recordedSpan) End() {
+	s.span.recorder.l.Lock()
+	if s.span.End.IsZero() {
+		s.span.End = time.Now()
+	}
+	s.span.recorder.l.Unlock()
+}
@@ -0,0 +1,271 @@
+package tcp_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directions of transcript entries.
+const (
+	// The client connected. The entry's text is its remote address.
+	TranscriptOpen = "open"
+	// A line was received from the client, as it was given to the message handlers or a prompt.
+	TranscriptIn = "in"
+	// A message was written to the client, without its line ending.
+	TranscriptOut = "out"
+	// The client disconnected. The entry's text is the reason.
+	TranscriptClose = "close"
+)
+
+// TranscriptEntry is a single event in a client's session.
+// Transcripts written by JSONTranscript hold one entry per line, as a JSON object such as
+//
+//	{"time":"2006-01-02T15:04:05.999999999Z","client":1,"dir":"in","text":"hello"}
+type TranscriptEntry struct {
+	Time   time.Time `json:"time"`
+	Client int64     `json:"client"`
+	// One of TranscriptOpen, TranscriptIn, TranscriptOut or TranscriptClose.
+	Dir  string `json:"dir"`
+	Text string `json:"text"`
+}
+
+// TranscriptSink records the entries of a client's session.
+// Record may be called concurrently, and Close is called once the client has disconnected.
+type TranscriptSink interface {
+	Record(e TranscriptEntry) error
+	Close() error
+}
+
+// Records the sessions of clients connecting from now on.
+// open is called for each client once it has an ID, and returns the sink to record it to, or nil to not record it.
+// Set open to nil to stop recording, which is the default.
+func (s *Server) SetTranscript(open func(c *Client) TranscriptSink) {
+	s.Lock()
+	s.transcript = open
+	s.Unlock()
+}
+
+// Records an entry in the client's transcript, if it has one.
+func (c *Client) record(dir string, text string) {
+	t := c.transcript.Load()
+	if t == nil {
+		return
+	}
+	(*t).Record(TranscriptEntry{Time: time.Now(), Client: int64(c.id), Dir: dir, Text: text})
+}
+
+// JSONTranscript is a TranscriptSink that writes entries to a writer as JSON lines.
+// It can be shared by several clients, and closing it doesn't close the writer.
+type JSONTranscript struct {
+	l   sync.Mutex
+	enc *json.Encoder
+}
+
+// Creates a sink writing to w, which is left open when the sink is closed.
+func NewJSONTranscript(w io.Writer) *JSONTranscript {
+	return &JSONTranscript{enc: json.NewEncoder(w)}
+}
+
+func (t *JSONTranscript) Record(e TranscriptEntry) error {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.enc.Encode(e)
+}
+
+func (t *JSONTranscript) Close() error {
+	return nil
+}
+
+// Returns a function to give to SetTranscript, which records each client to a file of JSON lines of its own in dir, named after the client's ID and when it connected.
+func TranscriptFiles(dir string) func(c *Client) TranscriptSink {
+	return func(c *Client) TranscriptSink {
+		name := strconv.FormatInt(c.ID(), 10) + "-" + c.connectedAt.UTC().Format("20060102T150405") + ".jsonl"
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			c.log(slog.LevelWarn, "unable to create transcript", slog.Any("error", err))
+			return nil
+		}
+		return &fileTranscript{JSONTranscript: NewJSONTranscript(f), f: f}
+	}
+}
+
+type fileTranscript struct {
+	*JSONTranscript
+	f *os.File
+}
+
+func (t *fileTranscript) Close() error {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.f.Close()
+}
+
+// MemoryTranscript is a TranscriptSink that keeps entries in memory.
+// It can be shared by several clients.
+type MemoryTranscript struct {
+	l       sync.Mutex
+	entries []TranscriptEntry
+}
+
+func (t *MemoryTranscript) Record(e TranscriptEntry) error {
+	t.l.Lock()
+	t.entries = append(t.entries, e)
+	t.l.Unlock()
+	return nil
+}
+
+func (t *MemoryTranscript) Close() error {
+	return nil
+}
+
+// Returns a copy of the entries recorded so far.
+func (t *MemoryTranscript) Entries() []TranscriptEntry {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return append([]TranscriptEntry(nil), t.entries...)
+}
+
+// Reads a transcript written by JSONTranscript.
+func ReadTranscript(r io.Reader) ([]TranscriptEntry, error) {
+	var entries []TranscriptEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxPooledBuffer)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var e TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Feeds the input of a recorded session into s as a new client, and compares what s writes to it with the recorded output.
+// The entries must all belong to one client's session. Each input line is sent once the output recorded before it has been written, waiting up to timeout for it, so prompts are answered as they were when the session was recorded.
+// Returns the differences between the recorded and replayed output: the lines only recorded, prefixed with "-", and the lines only replayed, prefixed with "+". It is empty if they match.
+// s doesn't need to have been started, but must have its callbacks set.
+func Replay(s *Server, entries []TranscriptEntry, timeout time.Duration) ([]string, error) {
+	for _, e := range entries {
+		if e.Client != entries[0].Client {
+			return nil, errors.New("transcript holds more than one client")
+		}
+	}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	// Lines written by the server are collected as they arrive, so that it never blocks writing them.
+	var l sync.Mutex
+	var written []string
+	arrived := make(chan struct{}, 1)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		r := bufio.NewReader(remote)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			l.Lock()
+			written = append(written, strings.TrimRight(line, "\r\n"))
+			l.Unlock()
+			select {
+			case arrived <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	c := s.newClient(local)
+	s.wg.Add(1)
+	go s.add(c)
+
+	var expected []string
+	// Waits until as many lines have been written as were recorded so far, or the timeout passes.
+	wait := func() {
+		deadline := time.After(timeout)
+		for {
+			l.Lock()
+			n := len(written)
+			l.Unlock()
+			if n >= len(expected) {
+				return
+			}
+			select {
+			case <-arrived:
+			case <-finished:
+				return
+			case <-deadline:
+				return
+			}
+		}
+	}
+replay:
+	for _, e := range entries {
+		switch e.Dir {
+		case TranscriptOut:
+			for _, line := range strings.Split(e.Text, "\n") {
+				expected = append(expected, strings.TrimRight(line, "\r"))
+			}
+		case TranscriptIn:
+			wait()
+			remote.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err := io.WriteString(remote, e.Text+"\r\n"); err != nil {
+				break replay
+			}
+		}
+	}
+	wait()
+	c.Close()
+	<-finished
+	got := written
+	return diffLines(expected, got), nil
+}
+
+// Returns the lines only expected, prefixed with "-", and the lines only got, prefixed with "+", each with its line number, in the order of a diff.
+func diffLines(expected, got []string) []string {
+	// common[i][j] is the length of the longest common subsequence of expected[i:] and got[j:].
+	common := make([][]int, len(expected)+1)
+	for i := range common {
+		common[i] = make([]int, len(got)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(got) - 1; j >= 0; j-- {
+			if expected[i] == got[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(expected) || j < len(got) {
+		switch {
+		case i < len(expected) && j < len(got) && expected[i] == got[j]:
+			i++
+			j++
+		case i < len(expected) && (j == len(got) || common[i+1][j] >= common[i][j+1]):
+			diff = append(diff, fmt.Sprintf("-%d: %s", i+1, expected[i]))
+			i++
+		default:
+			diff = append(diff, fmt.Sprintf("+%d: %s", j+1, got[j]))
+			j++
+		}
+	}
+	return diff
+}